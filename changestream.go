@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rwynn/gtm/v2"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// changeEventNs is the namespace of a change stream event
+type changeEventNs struct {
+	Database   string `bson:"db"`
+	Collection string `bson:"coll"`
+}
+
+// changeEvent holds the fields of a change stream event
+// that are needed to build a gtm.Op for the consumers
+type changeEvent struct {
+	OperationType     string              `bson:"operationType"`
+	DocumentKey       bson.M              `bson:"documentKey"`
+	FullDocument      bson.M              `bson:"fullDocument"`
+	Ns                changeEventNs       `bson:"ns"`
+	ClusterTime       primitive.Timestamp `bson:"clusterTime"`
+	UpdateDescription bson.M              `bson:"updateDescription"`
+}
+
+// toOp converts the event into the same gtm.Op shape the oplog
+// tailer produces, so processOp doesn't care about the source
+func (e *changeEvent) toOp(token string) *gtm.Op {
+	op := &gtm.Op{
+		Id:          e.DocumentKey["_id"],
+		Namespace:   createFanKey(e.Ns.Database, e.Ns.Collection),
+		Timestamp:   e.ClusterTime,
+		Source:      gtm.OplogQuerySource,
+		ResumeToken: gtm.OpResumeToken{ResumeToken: token},
+	}
+	switch e.OperationType {
+	case "insert":
+		op.Operation = "i"
+	case "update", "replace":
+		op.Operation = "u"
+	case "delete":
+		op.Operation = "d"
+	}
+	if e.FullDocument != nil {
+		op.Data = e.FullDocument
+	}
+	if e.UpdateDescription != nil {
+		op.UpdateDescription = e.UpdateDescription
+	}
+	return op
+}
+
+// fatalChangeStreamErrorCodes are the server errors reopening the stream
+// can't fix: history lost, fatal change stream error and change streams
+// not supported by the deployment
+var fatalChangeStreamErrorCodes = []int{280, 286, 40573}
+
+func fatalChangeStreamError(err error) bool {
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return false
+	}
+	for _, code := range fatalChangeStreamErrorCodes {
+		if serverErr.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// resumeTokenData extracts the opaque _data string of a resume token
+func resumeTokenData(token bson.Raw) string {
+	if token == nil {
+		return ""
+	}
+	data, ok := token.Lookup("_data").StringValueOK()
+	if !ok {
+		return ""
+	}
+	return data
+}
+
+// changeStreamPipeline only lets through the document level
+// changes of the collections present in the fieldsMap
+func (t *syncronizer) changeStreamPipeline() mongo.Pipeline {
+	namespaces := bson.A{}
+	for dbName, db := range t.fieldMap {
+		for collectionName := range db.Collections {
+			namespaces = append(namespaces, bson.M{"ns.db": dbName, "ns.coll": collectionName})
+		}
+	}
+	return mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"operationType": bson.M{"$in": bson.A{"insert", "update", "replace", "delete"}},
+			"$or":           namespaces,
+		}}},
+	}
+}
+
+// openChangeStream watches the database when the fieldsMap has a single
+// database, otherwise the whole deployment. The stream resumes after token
+// when we have one, else it starts at lastEpoch or now.
+func (t *syncronizer) openChangeStream(ctx context.Context, token string, lastEpoch int64) (*mongo.ChangeStream, error) {
+	opts := options.ChangeStream()
+	if t.setting.fullDocument {
+		opts.SetFullDocument(options.UpdateLookup)
+	}
+	if token != "" {
+		opts.SetResumeAfter(bson.M{"_data": token})
+	} else if lastEpoch != 0 && lastEpoch <= time.Now().Unix() {
+		opts.SetStartAtOperationTime(&primitive.Timestamp{T: uint32(lastEpoch), I: 1})
+	}
+	pipeline := t.changeStreamPipeline()
+	if len(t.fieldMap) == 1 {
+		for dbName := range t.fieldMap {
+			return t.mgoClient.Database(dbName).Watch(ctx, pipeline, opts)
+		}
+	}
+	return t.mgoClient.Watch(ctx, pipeline, opts)
+}
+
+// snapshotPosition is the checkpoint of the oplog before a replication scans
+// the collections, a sync starting from it sees every change the scans may miss
+func (t *syncronizer) snapshotPosition(ctx context.Context) (Checkpoint, error) {
+	c := Checkpoint{AppName: t.syncName, ProcessedAt: time.Now()}
+	var hello bson.Raw
+	if err := t.mgoClient.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return c, err
+	}
+	ts, _, ok := hello.Lookup("operationTime").TimestampOK()
+	if !ok {
+		return c, errors.New("the cluster time is missing, syncing needs a replica set")
+	}
+	c.LastEpoch = int64(ts)
+	if t.setting.changeStream {
+		stream, err := t.openChangeStream(ctx, "", 0)
+		if err != nil {
+			return c, err
+		}
+		defer stream.Close(context.Background())
+		c.ResumeToken = resumeTokenData(stream.ResumeToken())
+	}
+	return c, nil
+}
+
+// watch streams the changes as gtm ops, it reopens the stream
+// from the last seen resume token whenever the stream fails
+func (t *syncronizer) watch(ctx context.Context, token string, lastEpoch int64) gtmTail {
+	ops := make(gtm.OpChan, 500)
+	errs := make(chan error)
+	sendErr := func(err error) {
+		select {
+		case errs <- err:
+		case <-ctx.Done():
+		}
+	}
+	go func() {
+		for ctx.Err() == nil {
+			stream, err := t.openChangeStream(ctx, token, lastEpoch)
+			if err != nil {
+				if fatalChangeStreamError(err) {
+					t.fail(err)
+					return
+				}
+				sendErr(err)
+				select {
+				case <-time.After(time.Second):
+				case <-ctx.Done():
+				}
+				continue
+			}
+			log.Infof("Watching change stream, resume token : %q", token)
+			t.status.recovered()
+			for stream.Next(ctx) {
+				var event changeEvent
+				if err := stream.Decode(&event); err != nil {
+					sendErr(err)
+					continue
+				}
+				token = resumeTokenData(stream.ResumeToken())
+				lastEpoch = 0
+				select {
+				case ops <- event.toOp(token):
+				case <-ctx.Done():
+				}
+			}
+			err = stream.Err()
+			stream.Close(context.Background())
+			if err != nil && ctx.Err() == nil {
+				if fatalChangeStreamError(err) {
+					t.fail(err)
+					return
+				}
+				sendErr(err)
+			}
+		}
+	}()
+	return gtmTail{ops, errs, nil}
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// Checkpoint is the position a sync resumes from after a restart
+type Checkpoint struct {
+	AppName     string    `db:"app_name" json:"app_name"`
+	LastEpoch   int64     `db:"last_epoch" json:"last_epoch"`
+	ResumeToken string    `db:"resume_token" json:"resume_token"`
+	ProcessedAt time.Time `db:"processed_at" json:"processed_at"`
+}
+
+// CheckpointStore saves and loads the checkpoints of the syncs, select
+// one with syncOptions.SetCheckpointStore
+type CheckpointStore interface {
+	// Load returns the last saved checkpoint of the sync,
+	// a zero Checkpoint when the sync never saved one
+	Load(syncName string) (Checkpoint, error)
+	// Save replaces the checkpoint of checkpoint.AppName
+	Save(checkpoint Checkpoint) error
+}
+
+// txCheckpointStore is a store able to save the checkpoint in the
+// transaction of a batch, which the transactional mode needs
+type txCheckpointStore interface {
+	saveTx(tx *sqlx.Tx, checkpoint Checkpoint) error
+}
+
+type postgresCheckpointStore struct {
+	pg     *sqlx.DB
+	schema string
+	table  string
+}
+
+// NewPostgresCheckpointStore keeps the checkpoints in schema.table of pg, the
+// table is created on the first Load. Sync uses monresql_metadata in the
+// schema of SetMetadataSchema, public by default, when no store is set.
+func NewPostgresCheckpointStore(pg *sqlx.DB, schema, table string) CheckpointStore {
+	return &postgresCheckpointStore{pg: pg, schema: schema, table: table}
+}
+
+func (p *postgresCheckpointStore) Load(syncName string) (Checkpoint, error) {
+	metadata := Checkpoint{}
+	q := queries{}
+	err := p.pg.Get(&metadata, q.GetMetadata(p.schema, p.table), syncName)
+	// No rows means this is first time with table
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error while reading %s table %+v", p.table, err)
+		c := commands{}
+		query := c.CreateTableSQL(p.schema, p.table)
+		query1 := strings.Replace(query, "$USERNAME", getPqUserName(p.pg), 1)
+		log.Println("Executed Query : ", query)
+		_, err := p.pg.DB.Exec(query1)
+		if err != nil {
+			log.Println("MetaTable Creating Error : ", err)
+			return metadata, err
+		}
+		log.Println("table created Sucessfuly")
+	}
+	// tables created before change stream support miss the resume_token column
+	if _, err := p.pg.DB.Exec(q.AddResumeTokenColumn(p.schema, p.table)); err != nil {
+		log.Println("MetaTable resume_token column error : ", err)
+		return metadata, err
+	}
+	return metadata, nil
+}
+
+func (p *postgresCheckpointStore) Save(checkpoint Checkpoint) error {
+	q := queries{}
+	result, err := p.pg.NamedExec(q.SaveMetadata(p.schema, p.table), checkpoint)
+	if err != nil {
+		log.Errorf("Unable to save into %s: %+v, %+v", p.table, result, err.Error())
+	}
+	return err
+}
+
+func (p *postgresCheckpointStore) saveTx(tx *sqlx.Tx, checkpoint Checkpoint) error {
+	q := queries{}
+	_, err := sqlx.NamedExec(tx, q.SaveMetadata(p.schema, p.table), checkpoint)
+	return err
+}
+
+type fileCheckpointStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileCheckpointStore keeps the checkpoints as json in a local file, useful
+// when the target database is read only for the sync's own bookkeeping
+func NewFileCheckpointStore(path string) CheckpointStore {
+	return &fileCheckpointStore{path: path}
+}
+
+func (f *fileCheckpointStore) read() (map[string]Checkpoint, error) {
+	checkpoints := make(map[string]Checkpoint)
+	b, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return checkpoints, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return checkpoints, nil
+	}
+	err = json.Unmarshal(b, &checkpoints)
+	return checkpoints, err
+}
+
+func (f *fileCheckpointStore) Load(syncName string) (Checkpoint, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	checkpoints, err := f.read()
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	return checkpoints[syncName], nil
+}
+
+// Save rewrites the file through a temporary file, so a crash never leaves it half written
+func (f *fileCheckpointStore) Save(checkpoint Checkpoint) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	checkpoints, err := f.read()
+	if err != nil {
+		return err
+	}
+	checkpoints[checkpoint.AppName] = checkpoint
+	b, err := json.MarshalIndent(checkpoints, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+type memoryCheckpointStore struct {
+	mu          sync.Mutex
+	checkpoints map[string]Checkpoint
+}
+
+// NewMemoryCheckpointStore keeps the checkpoints in memory, they survive a
+// restart of the sync but not of the process
+func NewMemoryCheckpointStore() CheckpointStore {
+	return &memoryCheckpointStore{checkpoints: make(map[string]Checkpoint)}
+}
+
+func (m *memoryCheckpointStore) Load(syncName string) (Checkpoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.checkpoints[syncName], nil
+}
+
+func (m *memoryCheckpointStore) Save(checkpoint Checkpoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkpoints[checkpoint.AppName] = checkpoint
+	return nil
+}
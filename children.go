@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rwynn/gtm/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// child maps an array of subdocuments to a table of its own, every element
+// is a row keyed by the _id of its parent document and its index in the array
+type child struct {
+	Path        string `json:"-"`
+	PgSchema    string `json:"pg_schema"`
+	PgTable     string `json:"pg_table"`
+	ParentKey   string `json:"parent_key"`
+	IndexColumn string `json:"index_column"`
+	Fields      fields `json:"fields"`
+}
+
+type childDelayed struct {
+	PgSchema    string          `json:"pg_schema"`
+	PgTable     string          `json:"pg_table"`
+	ParentKey   string          `json:"parent_key"`
+	IndexColumn string          `json:"index_column"`
+	Fields      json.RawMessage `json:"fields"`
+}
+
+// children are the child tables of a collection keyed by their array path
+type children map[string]child
+
+type childrenDelayed map[string]childDelayed
+
+func (c child) pgTableQuoted() string {
+	return quoteTable(c.PgSchema, c.PgTable)
+}
+
+// jsonToChildren decodes the children of a collection, the parent key
+// defaults to parent_id, the index column to array_index and the schema
+// to the one of the parent table
+func jsonToChildren(delayed childrenDelayed, schema string) (children, error) {
+	result := children{}
+	for path, v := range delayed {
+		if v.PgTable == "" {
+			return nil, fmt.Errorf("child %s needs a pg_table", path)
+		}
+		f, err := jsonToFields(string(v.Fields))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode the fields of child %s: %w", path, err)
+		}
+		c := child{Path: path, PgSchema: v.PgSchema, PgTable: v.PgTable, ParentKey: v.ParentKey, IndexColumn: v.IndexColumn, Fields: f}
+		if c.PgSchema == "" {
+			c.PgSchema = schema
+		}
+		if c.ParentKey == "" {
+			c.ParentKey = "parent_id"
+		}
+		if c.IndexColumn == "" {
+			c.IndexColumn = "array_index"
+		}
+		result[path] = c
+	}
+	return result, nil
+}
+
+// paths lists the array paths in order
+func (c children) paths() []string {
+	paths := []string{}
+	for p := range c {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// pathsOverlap reports whether a path of a is one of b, or above or below one of them
+func pathsOverlap(a, b []string) bool {
+	for _, p := range a {
+		for _, q := range b {
+			if p == q || strings.HasPrefix(p, q+".") || strings.HasPrefix(q, p+".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withChildrenTx runs fn in a transaction when the collection has child tables
+// or a history table, so the row, its child rows and its versions change
+// together. A transaction of a batch is used as is.
+func withChildrenTx(ctx context.Context, ex sqlx.Ext, c coll, fn func(sqlx.Ext) error) error {
+	db, ok := ex.(*sqlx.DB)
+	if len(c.Children) == 0 && !c.History || !ok {
+		return fn(ex)
+	}
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// writeChildren replaces the child rows of a document. A deleted document
+// loses its child rows, a partial document only replaces the arrays it holds.
+func writeChildren(ex sqlx.Ext, c coll, id interface{}, doc map[string]interface{}, deleted bool, full bool) error {
+	parent := pgID(id)
+	for _, path := range c.Children.paths() {
+		ch := c.Children[path]
+		o := childStatement{ch}
+		value, found := lookupPath(doc, path)
+		if !deleted && !found && !full {
+			continue
+		}
+		if _, err := sqlx.NamedExec(ex, o.BuildDelete(), map[string]interface{}{ch.ParentKey: parent}); err != nil {
+			return err
+		}
+		if deleted {
+			continue
+		}
+		elements, _ := asArray(value)
+		for i, e := range elements {
+			element, ok := asDoc(e)
+			if !ok {
+				log.Debugf("Skipping the element %d of %s, it is not a document", i, path)
+				continue
+			}
+			row := sanitizeData(ch.Fields, &gtm.Op{Operation: "i", Data: element})
+			row[ch.ParentKey] = parent
+			row[ch.IndexColumn] = i
+			if _, err := sqlx.NamedExec(ex, o.BuildInsert(), row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// uniqueIndex is the index the child rows of a parent are deleted and kept unique with
+func (ch child) uniqueIndex() string {
+	return fmt.Sprintf(`CREATE UNIQUE INDEX IF NOT EXISTS "%s_%s_%s_uindex" ON %s ("%s", "%s");`,
+		ch.PgTable, ch.ParentKey, ch.IndexColumn, ch.pgTableQuoted(), ch.ParentKey, ch.IndexColumn)
+}
+
+// childFields are the columns a child table needs: the parent key, typed
+// like the _id of the parent, the index column and the mapped fields
+func childFields(parent coll, ch child) fields {
+	result := fields{}
+	for k, v := range ch.Fields {
+		result[k] = v
+	}
+	result[ch.ParentKey] = field{mongoDB{"_id", "id"}, postgresDB{ch.ParentKey, parent.Fields["_id"].Postgres.Type}}
+	result[ch.IndexColumn] = field{mongoDB{ch.IndexColumn, "int"}, postgresDB{ch.IndexColumn, "INTEGER"}}
+	return result
+}
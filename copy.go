@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// copyLoader batches the documents of every collection and bulk loads them
+// through staging tables of its own, so loaders never share a staging table
+type copyLoader struct {
+	z       *replica
+	worker  int
+	batches map[string][]dbResult
+	staged  map[string]bool
+}
+
+func (z *replica) copyWriter(ctx context.Context, worker int, wg1 *sync.WaitGroup) {
+	defer wg1.Done()
+	l := &copyLoader{z: z, worker: worker, batches: make(map[string][]dbResult), staged: make(map[string]bool)}
+	defer l.dropStaging()
+	for e := range z.C {
+		key := createFanKey(e.MongoDB, e.Collection)
+		l.batches[key] = append(l.batches[key], e)
+		if len(l.batches[key]) >= z.option.copyBatchSize {
+			l.flush(ctx, key)
+		}
+	}
+	for key := range l.batches {
+		l.flush(ctx, key)
+	}
+}
+
+// stagingTable is the quoted name of the staging table of a collection for
+// this loader, it lives in the schema of the table
+func (l *copyLoader) stagingTable(c coll) string {
+	return quoteTable(c.PgSchema, fmt.Sprintf("monresql_stage_%s_%d", c.PgTable, l.worker))
+}
+
+// flush loads a batch, when the batch fails its documents are upserted one by
+// one so only the failing ones are dead lettered
+func (l *copyLoader) flush(ctx context.Context, key string) {
+	batch := l.batches[key]
+	delete(l.batches, key)
+	if len(batch) == 0 || ctx.Err() != nil {
+		return
+	}
+	o, c := l.z.statementFromDbCollection(batch[0].MongoDB, batch[0].Collection)
+	rows := make([]map[string]interface{}, len(batch))
+	for i, e := range batch {
+		rows[i] = buildOpFromMgo(o.mongoFields(), e, c).Data
+	}
+	labels := []string{"sync", l.z.name, "namespace", key, "op", "insert"}
+	start := time.Now()
+	err := l.load(ctx, o, batch, rows)
+	metrics.observe("monresql_postgres_write_seconds", time.Since(start), labels...)
+	if err == nil {
+		report := l.z.report.Collections[key]
+		l.z.insertCounter.Incr(int64(len(rows)))
+		for _, e := range batch {
+			report.written()
+			metrics.inc("monresql_ops_applied_total", labels...)
+			e.done()
+		}
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	log.Warnf("COPY of %d documents into %s failed, upserting them one by one : %s", len(batch), c.PgTable, err.Error())
+	for _, e := range batch {
+		l.z.upsert(ctx, e)
+	}
+}
+
+// load copies the rows into the staging table and merges them into the table in one transaction
+func (l *copyLoader) load(ctx context.Context, o statement, batch []dbResult, rows []map[string]interface{}) error {
+	stage := l.stagingTable(o.Collection)
+	tx, err := l.z.Output.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, o.BuildStaging(stage)); err != nil {
+		return err
+	}
+	l.staged[stage] = true
+	stmt, err := tx.PrepareContext(ctx, o.BuildCopy(stage))
+	if err != nil {
+		return err
+	}
+	columns := o.postgresFields()
+	for _, row := range rows {
+		args := make([]interface{}, len(columns))
+		for i, column := range columns {
+			args[i] = row[column]
+		}
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	// lib/pq sends the buffered rows on the final empty exec
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, o.BuildMerge(stage)); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`TRUNCATE %s;`, stage)); err != nil {
+		return err
+	}
+	for i, e := range batch {
+		if err := l.z.deadLetters.supersede(tx, createFanKey(e.MongoDB, e.Collection), e.Data["_id"]); err != nil {
+			return err
+		}
+		if err := writeChildren(tx, o.Collection, e.Data["_id"], e.Data, false, true); err != nil {
+			return err
+		}
+		if err := writeHistory(tx, o.Collection, rows[i], l.z.report.StartedAt, false, true); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (l *copyLoader) dropStaging() {
+	for stage := range l.staged {
+		if _, err := l.z.Output.Exec(fmt.Sprintf(`DROP TABLE IF EXISTS %s;`, stage)); err != nil {
+			log.Warnf("Unable to drop the staging table %s : %s", stage, err.Error())
+		}
+	}
+}
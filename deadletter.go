@@ -0,0 +1,282 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rwynn/gtm/v2"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// deadLetter is a row of monresql_dead_letter, an op that failed to apply
+type deadLetter struct {
+	ID        int64     `db:"id"`
+	AppName   string    `db:"app_name"`
+	Namespace string    `db:"namespace"`
+	DocID     string    `db:"doc_id"`
+	OpType    string    `db:"op_type"`
+	Document  []byte    `db:"document"`
+	SQLError  string    `db:"sql_error"`
+	Attempts  int       `db:"attempts"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// ensureDeadLetterTable creates monresql_dead_letter in the schema of the monresql tables
+func ensureDeadLetterTable(pg *sqlx.DB, schema string) {
+	q := queries{}
+	if _, err := pg.DB.Exec(q.CreateDeadLetterTable(schema)); err != nil {
+		log.Println("Dead letter table creating error : ", err)
+	}
+}
+
+// idString renders a mongo _id the same way sanitizeData writes it
+func idString(id interface{}) string {
+	if oid, ok := id.(primitive.ObjectID); ok {
+		return oid.Hex()
+	}
+	return fmt.Sprint(id)
+}
+
+// errMissingRow is the error of a partial update finding no row to update
+var errMissingRow = errors.New("the row of the document is missing, the update only holds the changed fields")
+
+// deadLetterIndex remembers the documents having dead letters. Their later
+// updates are written whole, and a successful whole write removes the dead
+// letters it supersedes, so a replay can't bring back older data.
+type deadLetterIndex struct {
+	schema  string
+	appName string
+	mu      sync.Mutex
+	docs    map[string]bool
+}
+
+func newDeadLetterIndex(schema, appName string) *deadLetterIndex {
+	return &deadLetterIndex{schema: schema, appName: appName, docs: make(map[string]bool)}
+}
+
+func deadLetterKey(namespace string, id interface{}) string {
+	return namespace + "\x00" + idString(id)
+}
+
+// load reads the documents already dead lettered under the app name
+func (d *deadLetterIndex) load(pg *sqlx.DB) error {
+	q := queries{}
+	rows := []deadLetter{}
+	if err := pg.Select(&rows, q.GetDeadLetterDocs(d.schema), d.appName); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, row := range rows {
+		d.docs[row.Namespace+"\x00"+row.DocID] = true
+	}
+	return nil
+}
+
+// save dead letters the failed op and remembers its document
+func (d *deadLetterIndex) save(ex sqlx.Ext, op *gtm.Op, opErr error, attempts int) error {
+	d.mu.Lock()
+	d.docs[deadLetterKey(op.Namespace, op.Id)] = true
+	d.mu.Unlock()
+	return saveDeadLetter(ex, d.schema, d.appName, op, opErr, attempts)
+}
+
+func (d *deadLetterIndex) has(namespace string, id interface{}) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.docs[deadLetterKey(namespace, id)]
+}
+
+// supersede removes the dead letters of a document written whole through ex
+func (d *deadLetterIndex) supersede(ex sqlx.Ext, namespace string, id interface{}) error {
+	if !d.has(namespace, id) {
+		return nil
+	}
+	q := queries{}
+	if _, err := ex.Exec(q.DeleteDocDeadLetters(d.schema), d.appName, namespace, idString(id)); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	delete(d.docs, deadLetterKey(namespace, id))
+	d.mu.Unlock()
+	return nil
+}
+
+// saveDeadLetter keeps the raw document of the failed op together with the
+// sql error, ex is the transaction when the op was part of a batch
+func saveDeadLetter(ex sqlx.Ext, schema, appName string, op *gtm.Op, opErr error, attempts int) error {
+	document, err := json.Marshal(op.Data)
+	if err != nil {
+		return err
+	}
+	q := queries{}
+	_, err = sqlx.NamedExec(ex, q.SaveDeadLetter(schema), deadLetter{
+		AppName:   appName,
+		Namespace: op.Namespace,
+		DocID:     idString(op.Id),
+		OpType:    op.Operation,
+		Document:  document,
+		SQLError:  opErr.Error(),
+		Attempts:  attempts,
+	})
+	if err != nil {
+		log.Errorf("Unable to save into monresql_dead_letter: %s %v : %s", op.Namespace, op.Id, err.Error())
+	}
+	return err
+}
+
+// toOp rebuilds the failed op from the saved document
+func (d *deadLetter) toOp() (*gtm.Op, error) {
+	op := &gtm.Op{Id: d.DocID, Operation: d.OpType, Namespace: d.Namespace}
+	if len(d.Document) > 0 {
+		if err := json.Unmarshal(d.Document, &op.Data); err != nil {
+			return nil, err
+		}
+	}
+	if id, ok := op.Data["_id"]; ok && id != nil {
+		op.Id = id
+	}
+	return op, nil
+}
+
+// replayOp applies a dead lettered op. An update saved with the whole document
+// is upserted, one saved from an update description only sets its own fields
+// and fails when the row is missing.
+func replayOp(ex sqlx.Ext, c coll, op *gtm.Op) error {
+	o := statement{c}
+	var query string
+	switch {
+	case op.IsDelete():
+		if query = o.BuildRemove(); query == "" && !c.History {
+			return nil
+		}
+	case op.IsUpdate() && op.Data["_id"] == nil:
+		fields := []string{}
+		for _, k := range o.sortedKeys() {
+			if k != "_id" && hasPath(op.Data, k) {
+				fields = append(fields, k)
+			}
+		}
+		if len(fields) == 0 {
+			return nil
+		}
+		query = o.BuildUpdate(fields)
+	default:
+		query = o.BuildUpsert()
+	}
+	return withChildrenTx(context.Background(), ex, c, func(ex sqlx.Ext) error {
+		data := c.sanitize(op)
+		if query != "" {
+			result, err := sqlx.NamedExec(ex, query, data)
+			if err != nil {
+				return err
+			}
+			if op.IsUpdate() && op.Data["_id"] == nil {
+				if n, err := result.RowsAffected(); err == nil && n == 0 {
+					return errMissingRow
+				}
+			}
+		}
+		// the time of the failed op is lost, its version starts now
+		if err := writeHistory(ex, c, data, time.Now(), op.IsDelete(), false); err != nil {
+			return err
+		}
+		if op.IsDelete() && c.DeleteMode != DeleteHard {
+			return nil
+		}
+		return writeChildren(ex, c, op.Id, op.Data, op.IsDelete(), !op.IsUpdate() || op.Data["_id"] != nil)
+	})
+}
+
+// hasPath reports whether the dotted path is present in the document
+func hasPath(doc map[string]interface{}, path string) bool {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		child, ok := doc[k].(map[string]interface{})
+		if !ok {
+			return false
+		}
+		doc = child
+	}
+	_, ok := doc[keys[len(keys)-1]]
+	return ok
+}
+
+// ReplayDeadLetters applies again the ops of metadataSchema.monresql_dead_letter
+// saved under appName, the sync or replica name, in the order they failed. Run it once the
+// schema or the data is fixed, every replayed op is removed and the failing
+// ones stay with their new error, together with the later ops of their
+// document. It returns the number of replayed ops.
+func ReplayDeadLetters(fieldMap fieldsMap, pg *sqlx.DB, metadataSchema, appName string) (int, error) {
+	schema := metadataSchema
+	ensureDeadLetterTable(pg, schema)
+	q := queries{}
+	rows := []deadLetter{}
+	if err := pg.Select(&rows, q.GetDeadLetters(schema), appName); err != nil {
+		return 0, err
+	}
+	replayed := 0
+	var failed error
+	blocked := make(map[string]bool)
+	for _, row := range rows {
+		key := row.Namespace + "\x00" + row.DocID
+		op, err := row.toOp()
+		if blocked[key] {
+			err = errors.New("an earlier dead letter of the document failed again")
+		} else if err == nil {
+			c, ok := fieldMap[op.GetDatabase()].Collections[op.GetCollection()]
+			if !ok {
+				err = errors.New("collection is not in the fields map")
+			} else {
+				err = replayOp(pg, c, op)
+			}
+		}
+		if err != nil {
+			failed = err
+			blocked[key] = true
+			log.Errorf("Dead letter %d of %s %s not replayed : %s", row.ID, row.Namespace, row.DocID, err.Error())
+			if _, updateErr := pg.Exec(q.FailDeadLetter(schema), row.ID, err.Error()); updateErr != nil {
+				return replayed, updateErr
+			}
+			continue
+		}
+		if _, err := pg.Exec(q.DeleteDeadLetter(schema), row.ID); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	if failed != nil {
+		return replayed, fmt.Errorf("%d dead letters failed again, last error: %w", len(rows)-replayed, failed)
+	}
+	return replayed, nil
+}
@@ -37,14 +37,21 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	monresql.Replicate(dMap, pq, clint, "students")
+	report, err := monresql.Replicate(context.Background(), dMap, pq, clint, "students", nil)
+	if err != nil {
+		fmt.Println(err)
+	}
+	for _, ns := range report.Namespaces() {
+		fmt.Printf("%+v\n", report.Collections[ns])
+	}
 	option := monresql.NewSyncOptions()
 	option.SetCheckPointPeriod(time.Second * 5)
-	stop := monresql.Sync(dMap, pq, clint, "students", option)
+	sync := monresql.Sync(dMap, pq, clint, "students", option)
 	fmt.Println("sync called after")
 	time.Sleep(time.Minute * 1)
+	fmt.Printf("sync status %+v\n", sync.Status())
 	fmt.Println("waited end")
-	stop()
+	sync.Stop()
 	time.Sleep(time.Minute * 10)
 
 }
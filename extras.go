@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/rwynn/gtm/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// extrasKey is the key of the field of the extras column, no mongo path starts with $
+const extrasKey = "$extras"
+
+// extrasField maps the extras column, sanitizeData leaves it empty and sanitize fills it
+func extrasField(column string) field {
+	return field{mongoDB{extrasKey, "object"}, postgresDB{column, "jsonb"}}
+}
+
+// mappedRoot reports whether the top level key is below a mapped field or a child array
+func (c coll) mappedRoot(key string) bool {
+	for k := range c.Fields {
+		if k != extrasKey && (k == key || strings.HasPrefix(k, key+".")) {
+			return true
+		}
+	}
+	for p := range c.Children {
+		if p == key || strings.HasPrefix(p, key+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// extras is the JSON object of the unmapped top level keys of a document
+func (c coll) extras(doc map[string]interface{}) string {
+	extras := make(map[string]interface{})
+	for k, v := range doc {
+		if k != extrasKey && !c.mappedRoot(k) {
+			extras[k] = v
+		}
+	}
+	b, err := json.Marshal(extras)
+	if err != nil {
+		log.Errorf("Failed to marshal the extras of %s into json %s", c.Name, err.Error())
+		return "{}"
+	}
+	return string(b)
+}
+
+// sanitize is sanitizeData with the extras column of a whole document
+func (c coll) sanitize(op *gtm.Op) map[string]interface{} {
+	data := sanitizeData(c.Fields, op)
+	if c.ExtrasColumn != "" && !op.IsDelete() {
+		data[c.ExtrasColumn] = c.extras(op.Data)
+	}
+	return data
+}
+
+// partialPaths reports whether an update of the paths can set only their
+// columns, an unmapped key changes the extras column which needs the whole document
+func (c coll) partialPaths(paths []string) bool {
+	if c.ExtrasColumn == "" {
+		return true
+	}
+	for _, p := range paths {
+		if !c.mappedRoot(strings.SplitN(p, ".", 2)[0]) {
+			return false
+		}
+	}
+	return true
+}
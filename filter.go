@@ -0,0 +1,421 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// filterOperators are the query operators the change filter can evaluate
+var filterOperators = map[string]bool{
+	"$eq": true, "$ne": true, "$gt": true, "$gte": true, "$lt": true, "$lte": true,
+	"$in": true, "$nin": true, "$exists": true, "$not": true,
+}
+
+// validateFilter checks that every operator of the filter can be evaluated
+// against the changes of a sync
+func validateFilter(filter bson.M) error {
+	for k, v := range filter {
+		switch k {
+		case "$and", "$or", "$nor":
+			subs, ok := asArray(v)
+			if !ok {
+				return fmt.Errorf("filter %s needs an array", k)
+			}
+			for _, sub := range subs {
+				doc, ok := asDoc(sub)
+				if !ok {
+					return fmt.Errorf("filter %s needs an array of documents", k)
+				}
+				if err := validateFilter(doc); err != nil {
+					return err
+				}
+			}
+		default:
+			if strings.HasPrefix(k, "$") {
+				return fmt.Errorf("filter operator %s is not supported", k)
+			}
+			if err := validateCondition(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateCondition(cond interface{}) error {
+	ops, ok := operatorDoc(cond)
+	if !ok {
+		return nil
+	}
+	for op, v := range ops {
+		if !filterOperators[op] {
+			return fmt.Errorf("filter operator %s is not supported", op)
+		}
+		if op == "$not" {
+			if _, ok := operatorDoc(v); !ok {
+				return fmt.Errorf("filter $not needs an operator document")
+			}
+			if err := validateCondition(v); err != nil {
+				return err
+			}
+		}
+		if op == "$in" || op == "$nin" {
+			if _, ok := asArray(v); !ok {
+				return fmt.Errorf("filter %s needs an array", op)
+			}
+		}
+	}
+	return nil
+}
+
+// filterPaths lists the document paths a filter reads
+func filterPaths(filter bson.M) []string {
+	paths := []string{}
+	for k, v := range filter {
+		switch k {
+		case "$and", "$or", "$nor":
+			subs, _ := asArray(v)
+			for _, sub := range subs {
+				if doc, ok := asDoc(sub); ok {
+					paths = append(paths, filterPaths(doc)...)
+				}
+			}
+		default:
+			paths = append(paths, k)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// matchFilter evaluates a query filter against a document the way mongo
+// would for the supported operators. A path goes through the arrays it meets,
+// a condition matches when one of the values reached does. Equality with null
+// matches a missing value, $exists only looks at the presence of the path.
+func matchFilter(doc map[string]interface{}, filter bson.M) bool {
+	for k, v := range filter {
+		switch k {
+		case "$and", "$or", "$nor":
+			subs, _ := asArray(v)
+			matched := 0
+			for _, sub := range subs {
+				if sub, ok := asDoc(sub); ok && matchFilter(doc, sub) {
+					matched++
+				}
+			}
+			if (k == "$and" && matched != len(subs)) || (k == "$or" && matched == 0) || (k == "$nor" && matched > 0) {
+				return false
+			}
+		default:
+			values, found := pathValues(doc, k)
+			if !matchCondition(values, found, v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchCondition evaluates a condition against the values a path reached,
+// found is false when no value holds the path
+func matchCondition(values []interface{}, found bool, cond interface{}) bool {
+	ops, ok := operatorDoc(cond)
+	if !ok {
+		return matchEqual(values, cond)
+	}
+	for op, x := range ops {
+		var matched bool
+		switch op {
+		case "$eq":
+			matched = matchEqual(values, x)
+		case "$ne":
+			matched = !matchEqual(values, x)
+		case "$gt", "$gte", "$lt", "$lte":
+			matched = anyValue(values, func(e interface{}) bool {
+				c, ok := compareValues(e, x)
+				if !ok {
+					return false
+				}
+				switch op {
+				case "$gt":
+					return c > 0
+				case "$gte":
+					return c >= 0
+				case "$lt":
+					return c < 0
+				}
+				return c <= 0
+			})
+		case "$in", "$nin":
+			list, _ := asArray(x)
+			for _, candidate := range list {
+				if matchEqual(values, candidate) {
+					matched = true
+					break
+				}
+			}
+			if op == "$nin" {
+				matched = !matched
+			}
+		case "$exists":
+			matched = found == truthy(x)
+		case "$not":
+			matched = !matchCondition(values, found, x)
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// matchEqual compares the values, or any element of an array value, with x.
+// A missing value is a nil one, so null matches it.
+func matchEqual(values []interface{}, x interface{}) bool {
+	if x == nil {
+		for _, v := range values {
+			if v == nil {
+				return true
+			}
+		}
+		return len(values) == 0
+	}
+	for _, v := range values {
+		if v != nil && equalValues(v, x) {
+			return true
+		}
+	}
+	return anyValue(values, func(e interface{}) bool { return equalValues(e, x) })
+}
+
+// anyValue reports whether fn holds for one of the values or of the elements of an array value
+func anyValue(values []interface{}, fn func(interface{}) bool) bool {
+	for _, v := range values {
+		if v != nil && anyElement(v, fn) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyElement(value interface{}, fn func(interface{}) bool) bool {
+	if list, ok := asArray(value); ok {
+		for _, e := range list {
+			if fn(e) {
+				return true
+			}
+		}
+		return false
+	}
+	return fn(value)
+}
+
+func equalValues(a, b interface{}) bool {
+	if c, ok := compareValues(a, b); ok {
+		return c == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compareValues orders two values of the same BSON type bracket
+func compareValues(a, b interface{}) (int, bool) {
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+	if x, ok := toTime(a); ok {
+		if y, ok := toTime(b); ok {
+			return x.Compare(y), true
+		}
+		return 0, false
+	}
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case primitive.ObjectID:
+		if y, ok := b.(primitive.ObjectID); ok {
+			return bytes.Compare(x[:], y[:]), true
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0, true
+			case y:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func toTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case primitive.DateTime:
+		return t.Time(), true
+	case time.Time:
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+func truthy(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	if n, ok := toFloat(v); ok {
+		return n != 0
+	}
+	return v != nil
+}
+
+// operatorDoc returns the condition when it is a document of query operators
+func operatorDoc(cond interface{}) (map[string]interface{}, bool) {
+	doc, ok := asDoc(cond)
+	if !ok || len(doc) == 0 {
+		return nil, false
+	}
+	for k := range doc {
+		if !strings.HasPrefix(k, "$") {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// pathValues lists the values a dotted path reaches, an array on the way is
+// entered element by element, or indexed by a numeric key. A branch missing
+// the path below an array adds a nil value, found is true when one holds it.
+func pathValues(doc map[string]interface{}, path string) (values []interface{}, found bool) {
+	var walk func(value interface{}, keys []string, inArray bool)
+	walk = func(value interface{}, keys []string, inArray bool) {
+		if len(keys) == 0 {
+			values, found = append(values, value), true
+			return
+		}
+		if list, ok := asArray(value); ok {
+			if i, err := strconv.Atoi(keys[0]); err == nil {
+				if i >= 0 && i < len(list) {
+					walk(list[i], keys[1:], false)
+					return
+				}
+			}
+			for _, e := range list {
+				walk(e, keys, true)
+			}
+			return
+		}
+		current, ok := asDoc(value)
+		if ok {
+			if next, ok := current[keys[0]]; ok {
+				walk(next, keys[1:], false)
+				return
+			}
+		}
+		if inArray {
+			values = append(values, nil)
+		}
+	}
+	walk(doc, strings.Split(path, "."), false)
+	return values, found
+}
+
+// lookupPath follows a dotted path through the embedded documents
+func lookupPath(doc map[string]interface{}, path string) (interface{}, bool) {
+	keys := strings.Split(path, ".")
+	var value interface{} = doc
+	for _, k := range keys {
+		current, ok := asDoc(value)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = current[k]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func asDoc(v interface{}) (map[string]interface{}, bool) {
+	switch d := v.(type) {
+	case map[string]interface{}:
+		return d, true
+	case primitive.M:
+		return d, true
+	case primitive.D:
+		return d.Map(), true
+	}
+	return nil, false
+}
+
+func asArray(v interface{}) ([]interface{}, bool) {
+	switch a := v.(type) {
+	case []interface{}:
+		return a, true
+	case primitive.A:
+		return a, true
+	}
+	return nil, false
+}
+
+// filterChanged reports whether an update description touches a path the filter reads
+func filterChanged(filter bson.M, desc map[string]interface{}) bool {
+	return pathsOverlap(updatedPaths(desc), filterPaths(filter))
+}
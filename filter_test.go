@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMatchFilter(t *testing.T) {
+	doc := map[string]interface{}{
+		"n":      nil,
+		"status": "active",
+		"age":    int32(30),
+		"tags":   bson.A{"a", "b"},
+		"items":  bson.A{bson.M{"sku": "a", "qty": int32(1)}, bson.M{"sku": "b"}},
+		"owner":  map[string]interface{}{"name": "x", "address": bson.M{"city": "y"}},
+	}
+	tests := []struct {
+		name   string
+		filter string
+		want   bool
+	}{
+		{"equal", `{"status": "active"}`, true},
+		{"not equal", `{"status": "gone"}`, false},
+		{"eq operator", `{"status": {"$eq": "active"}}`, true},
+		{"ne", `{"status": {"$ne": "gone"}}`, true},
+		{"embedded path", `{"owner.address.city": "y"}`, true},
+		{"array element", `{"tags": "b"}`, true},
+		{"array element missing", `{"tags": "c"}`, false},
+		{"path through an array", `{"items.sku": "a"}`, true},
+		{"path through an array missing", `{"items.sku": "c"}`, false},
+		{"array index", `{"items.1.sku": "b"}`, true},
+		{"array index other element", `{"items.1.sku": "a"}`, false},
+		{"gt", `{"age": {"$gt": 18}}`, true},
+		{"lte", `{"age": {"$lte": 18}}`, false},
+		{"gt through an array", `{"items.qty": {"$gte": 1}}`, true},
+		{"in", `{"status": {"$in": ["active", "new"]}}`, true},
+		{"nin", `{"status": {"$nin": ["active"]}}`, false},
+		{"exists", `{"status": {"$exists": true}}`, true},
+		{"exists null", `{"n": {"$exists": true}}`, true},
+		{"exists missing", `{"missing": {"$exists": false}}`, true},
+		{"exists through an array", `{"items.qty": {"$exists": true}}`, true},
+		{"not exists through an array", `{"items.price": {"$exists": true}}`, false},
+		{"null matches null", `{"n": null}`, true},
+		{"null matches missing", `{"missing": null}`, true},
+		{"null matches a missing array branch", `{"items.qty": null}`, true},
+		{"null does not match a value", `{"status": null}`, false},
+		{"ne null on null", `{"n": {"$ne": null}}`, false},
+		{"not", `{"age": {"$not": {"$gt": 40}}}`, true},
+		{"and", `{"$and": [{"status": "active"}, {"age": 30}]}`, true},
+		{"or", `{"$or": [{"status": "gone"}, {"age": 30}]}`, true},
+		{"nor", `{"$nor": [{"status": "gone"}, {"age": 30}]}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := jsonToFilter([]byte(tt.filter))
+			if err != nil {
+				t.Fatalf("jsonToFilter(%s) error: %v", tt.filter, err)
+			}
+			if got := matchFilter(doc, filter); got != tt.want {
+				t.Fatalf("matchFilter(%s) = %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		ok     bool
+	}{
+		{`{"a": 1}`, true},
+		{`{"a": {"$in": [1, 2]}}`, true},
+		{`{"$or": [{"a": 1}, {"b": {"$exists": true}}]}`, true},
+		{`{"a": {"$regex": "x"}}`, false},
+		{`{"$where": "true"}`, false},
+		{`{"a": {"$in": 1}}`, false},
+		{`{"a": {"$not": 1}}`, false},
+	}
+	for _, tt := range tests {
+		_, err := jsonToFilter([]byte(tt.filter))
+		if (err == nil) != tt.ok {
+			t.Fatalf("jsonToFilter(%s) error = %v, want ok %v", tt.filter, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rwynn/gtm/v2"
+)
+
+// The columns of a history table besides the mapped fields
+const (
+	validFromColumn = "valid_from"
+	validToColumn   = "valid_to"
+	// validTsParam is the named parameter of the timestamp of a version
+	validTsParam = "monresql_valid_ts"
+)
+
+// historyTable is the table keeping the versions of the documents of a collection
+func (c coll) historyTable() string {
+	return c.PgTable + "_history"
+}
+
+func (c coll) historyTableQuoted() string {
+	return quoteTable(c.PgSchema, c.historyTable())
+}
+
+// historyFields are the columns of the history table, the mapped fields and the validity range
+func (c coll) historyFields() fields {
+	f := fields{}
+	for k, v := range c.Fields {
+		f[k] = v
+	}
+	f["$"+validFromColumn] = field{Postgres: postgresDB{Name: validFromColumn, Type: "timestamp with time zone"}}
+	f["$"+validToColumn] = field{Postgres: postgresDB{Name: validToColumn, Type: "timestamp with time zone"}}
+	return f
+}
+
+// opTime is the time of the op in the oplog, or now when it has none. The
+// oplog only counts seconds, its increment is added as microseconds so the
+// versions written in the same second keep their order.
+func opTime(op *gtm.Op) time.Time {
+	if op.Timestamp.T == 0 {
+		return time.Now()
+	}
+	return time.Unix(int64(op.Timestamp.T), 0).Add(time.Duration(op.Timestamp.I) * time.Microsecond)
+}
+
+// writeHistory records a version of a document valid from ts. The open
+// version is closed at ts first, unless snapshot is set: a snapshot only opens
+// a version for the documents without one. A deleted document only closes its
+// version. Replaying an op is a no op as the versions from ts on are kept.
+func writeHistory(ex sqlx.Ext, c coll, data map[string]interface{}, ts time.Time, deleted, snapshot bool) error {
+	if !c.History {
+		return nil
+	}
+	o := statement{c}
+	params := make(map[string]interface{}, len(data)+1)
+	for k, v := range data {
+		params[k] = v
+	}
+	params[validTsParam] = ts
+	if !snapshot {
+		if _, err := sqlx.NamedExec(ex, o.BuildHistoryClose(), params); err != nil {
+			return err
+		}
+	}
+	if deleted {
+		return nil
+	}
+	_, err := sqlx.NamedExec(ex, o.BuildHistoryInsert(), params)
+	return err
+}
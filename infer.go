@@ -0,0 +1,380 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// InferredPath is what the sampled documents hold at a dotted path
+type InferredPath struct {
+	Path string
+	// Seen is the number of sampled documents holding the path, Frequency their share
+	Seen      int64
+	Frequency float64
+	// Types counts the values of each BSON type, null included
+	Types     map[string]int64
+	MongoType string
+	PgType    string
+	PgName    string
+	// Ambiguous paths need a review before the mapfile is used, Reason tells why
+	Ambiguous bool
+	Reason    string
+	// mapped is false for the documents whose keys are mapped one by one
+	mapped bool
+}
+
+// InferredCollection is the result of sampling one collection
+type InferredCollection struct {
+	Database   string
+	Collection string
+	PgTable    string
+	Sampled    int64
+	Paths      []InferredPath
+}
+
+// InferredMap is a mapfile inferred from sampled documents with the statistics it comes from
+type InferredMap struct {
+	Collections []InferredCollection
+}
+
+// bsonTypeNames are the names of the BSON types in the mapfile and the statistics
+var bsonTypeNames = map[bsontype.Type]string{
+	bsontype.Double:           "double",
+	bsontype.String:           "string",
+	bsontype.EmbeddedDocument: "object",
+	bsontype.Array:            "array",
+	bsontype.Binary:           "binData",
+	bsontype.ObjectID:         "objectId",
+	bsontype.Boolean:          "bool",
+	bsontype.DateTime:         "date",
+	bsontype.Null:             "null",
+	bsontype.Undefined:        "null",
+	bsontype.Regex:            "regex",
+	bsontype.Int32:            "int",
+	bsontype.Timestamp:        "timestamp",
+	bsontype.Int64:            "long",
+	bsontype.Decimal128:       "decimal",
+}
+
+// pgTypes are the postgres types of the BSON types, text for the others
+var pgTypes = map[string]string{
+	"double":    "double precision",
+	"string":    "text",
+	"object":    "jsonb",
+	"array":     "jsonb",
+	"binData":   "bytea",
+	"objectId":  "text",
+	"bool":      "boolean",
+	"date":      "timestamp with time zone",
+	"int":       "integer",
+	"timestamp": "timestamp with time zone",
+	"long":      "bigint",
+	"decimal":   "numeric",
+}
+
+// numericRank orders the numeric types from the narrowest
+var numericRank = map[string]int{"int": 1, "long": 2, "double": 3, "decimal": 4}
+
+// InferFieldsMap samples sampleSize documents of each collection of the
+// database with $sample, or of every collection when none is given, and infers
+// the BSON types of their dotted paths. Embedded documents are mapped key by
+// key, arrays to jsonb columns. Numbers of several types get the widest type
+// and dates and timestamps a timestamptz. Any other mix of types, a path with
+// only nulls or a column name used twice is mapped to text and flagged as
+// ambiguous. MapFile renders the result for LoadFieldsMap.
+func InferFieldsMap(ctx context.Context, client *mongo.Client, dbName string, sampleSize int, collections ...string) (*InferredMap, error) {
+	db := client.Database(dbName)
+	if len(collections) == 0 {
+		names, err := db.ListCollectionNames(ctx, bson.M{"type": "collection"})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(names)
+		collections = names
+	}
+	result := &InferredMap{}
+	for _, name := range collections {
+		inferred, err := inferCollection(ctx, db.Collection(name), sampleSize)
+		if err != nil {
+			return result, fmt.Errorf("unable to sample %s.%s: %w", dbName, name, err)
+		}
+		result.Collections = append(result.Collections, inferred)
+	}
+	return result, nil
+}
+
+func inferCollection(ctx context.Context, coll *mongo.Collection, sampleSize int) (InferredCollection, error) {
+	inferred := InferredCollection{Database: coll.Database().Name(), Collection: coll.Name(), PgTable: pgName(coll.Name())}
+	cursor, err := coll.Aggregate(ctx, mongo.Pipeline{{{Key: "$sample", Value: bson.M{"size": sampleSize}}}})
+	if err != nil {
+		return inferred, err
+	}
+	defer cursor.Close(ctx)
+	paths := make(map[string]*InferredPath)
+	for cursor.Next(ctx) {
+		inferred.Sampled++
+		if err := walkDocument(paths, "", cursor.Current); err != nil {
+			return inferred, err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return inferred, err
+	}
+	keys := []string{}
+	for k := range paths {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	names := make(map[string]string)
+	leaves := make(map[string]bool)
+	for _, k := range keys {
+		p := paths[k]
+		// the keys of a document mapped as a whole are in its column
+		if belowLeaf(leaves, k) {
+			continue
+		}
+		if inferred.Sampled > 0 {
+			p.Frequency = float64(p.Seen) / float64(inferred.Sampled)
+		}
+		p.resolve()
+		if p.mapped {
+			leaves[k] = true
+			p.PgName = pgName(k)
+			if other, used := names[p.PgName]; used {
+				p.flag(fmt.Sprintf("column %s is also the column of %s", p.PgName, other))
+				p.PgName = uniqueName(names, p.PgName)
+			}
+			names[p.PgName] = k
+		}
+		inferred.Paths = append(inferred.Paths, *p)
+	}
+	return inferred, nil
+}
+
+// belowLeaf reports whether a parent of the path is mapped to a column
+func belowLeaf(leaves map[string]bool, path string) bool {
+	for i := strings.Index(path, "."); i >= 0; i = nextDot(path, i) {
+		if leaves[path[:i]] {
+			return true
+		}
+	}
+	return false
+}
+
+func nextDot(path string, i int) int {
+	j := strings.Index(path[i+1:], ".")
+	if j < 0 {
+		return -1
+	}
+	return i + 1 + j
+}
+
+// walkDocument counts the type of every key of a document, the keys of its embedded documents included
+func walkDocument(paths map[string]*InferredPath, prefix string, doc bson.Raw) error {
+	elements, err := doc.Elements()
+	if err != nil {
+		return err
+	}
+	for _, e := range elements {
+		key := e.Key()
+		path := prefix + key
+		p, ok := paths[path]
+		if !ok {
+			p = &InferredPath{Path: path, Types: make(map[string]int64)}
+			paths[path] = p
+		}
+		p.Seen++
+		if strings.Contains(key, ".") {
+			p.flag("the key holds a dot, the dotted path can not reach it")
+			continue
+		}
+		v := e.Value()
+		typeName, known := bsonTypeNames[v.Type]
+		if !known {
+			typeName = v.Type.String()
+		}
+		p.Types[typeName]++
+		if v.Type == bsontype.EmbeddedDocument {
+			if err := walkDocument(paths, path+".", v.Document()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *InferredPath) flag(reason string) {
+	p.Ambiguous = true
+	if p.Reason != "" {
+		reason = p.Reason + ", " + reason
+	}
+	p.Reason = reason
+}
+
+// resolve picks the types of the column of the path from the types seen
+func (p *InferredPath) resolve() {
+	types := []string{}
+	for t := range p.Types {
+		if t != "null" {
+			types = append(types, t)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if p.Types[types[i]] != p.Types[types[j]] {
+			return p.Types[types[i]] > p.Types[types[j]]
+		}
+		return types[i] < types[j]
+	})
+	p.mapped = true
+	switch {
+	case len(p.Types) == 0:
+		// only keys holding a dot
+		p.mapped = false
+	case len(types) == 0:
+		p.MongoType, p.PgType = "null", "text"
+		p.flag("only null values were sampled")
+	case len(types) == 1 && types[0] == "object":
+		// an embedded document is mapped key by key
+		p.MongoType, p.mapped = "object", false
+	case len(types) == 1:
+		p.MongoType, p.PgType = types[0], pgType(types[0])
+	case allOf(types, "int", "long", "double", "decimal"):
+		widest := types[0]
+		for _, t := range types {
+			if numericRank[t] > numericRank[widest] {
+				widest = t
+			}
+		}
+		p.MongoType, p.PgType = widest, pgType(widest)
+	case allOf(types, "date", "timestamp"):
+		p.MongoType, p.PgType = types[0], pgType("date")
+	case allOf(types, "object", "array"):
+		p.MongoType, p.PgType = types[0], "jsonb"
+		p.flag("mixes documents and arrays")
+	default:
+		p.MongoType, p.PgType = types[0], "text"
+		p.flag("conflicting types " + strings.Join(types, ", "))
+	}
+}
+
+func pgType(mongoType string) string {
+	if t, ok := pgTypes[mongoType]; ok {
+		return t
+	}
+	return "text"
+}
+
+// allOf reports whether every type is one of the allowed types
+func allOf(types []string, allowed ...string) bool {
+	for _, t := range types {
+		found := false
+		for _, a := range allowed {
+			found = found || t == a
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	camelBoundary = regexp.MustCompile(`([a-z0-9])([A-Z])`)
+	nonIdentifier = regexp.MustCompile(`[^a-z0-9_]+`)
+)
+
+// pgName renders a dotted path as a lower snake case column name, so it needs no quoting
+func pgName(path string) string {
+	name := camelBoundary.ReplaceAllString(normalizeDotNotationToPostgresNaming(path), "${1}_${2}")
+	name = nonIdentifier.ReplaceAllString(strings.ToLower(name), "_")
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+func uniqueName(names map[string]string, name string) string {
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s_%d", name, i)
+		if _, used := names[candidate]; !used {
+			return candidate
+		}
+	}
+}
+
+// Ambiguous lists the paths to review before the mapfile is used
+func (m *InferredMap) Ambiguous() []InferredPath {
+	paths := []InferredPath{}
+	for _, c := range m.Collections {
+		for _, p := range c.Paths {
+			if p.Ambiguous {
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths
+}
+
+type inferredCollectionFile struct {
+	Name    string `json:"name"`
+	PgTable string `json:"pg_table"`
+	Fields  fields `json:"fields"`
+}
+
+type inferredDBFile struct {
+	Collections map[string]inferredCollectionFile `json:"collections"`
+}
+
+// MapFile renders the mapfile with the longhand fields, ready for LoadFieldsMap
+func (m *InferredMap) MapFile() (string, error) {
+	file := make(map[string]inferredDBFile)
+	for _, c := range m.Collections {
+		db, ok := file[c.Database]
+		if !ok {
+			db = inferredDBFile{Collections: make(map[string]inferredCollectionFile)}
+			file[c.Database] = db
+		}
+		f := fields{}
+		for _, p := range c.Paths {
+			if p.mapped {
+				f[p.Path] = field{mongoDB{p.Path, p.MongoType}, postgresDB{p.PgName, p.PgType}}
+			}
+		}
+		db.Collections[c.Collection] = inferredCollectionFile{Name: c.Collection, PgTable: c.PgTable, Fields: f}
+	}
+	b, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import "testing"
+
+func TestInferredPathResolve(t *testing.T) {
+	tests := []struct {
+		name      string
+		types     map[string]int64
+		mongoType string
+		pgType    string
+		mapped    bool
+		ambiguous bool
+	}{
+		{"single type", map[string]int64{"string": 3}, "string", "text", true, false},
+		{"single type with nulls", map[string]int64{"int": 3, "null": 5}, "int", "integer", true, false},
+		{"numbers widen", map[string]int64{"int": 5, "long": 1}, "long", "bigint", true, false},
+		{"numbers widen to decimal", map[string]int64{"int": 5, "double": 2, "decimal": 1}, "decimal", "numeric", true, false},
+		{"date and timestamp", map[string]int64{"timestamp": 1, "date": 4}, "date", "timestamp with time zone", true, false},
+		{"object only", map[string]int64{"object": 2}, "object", "", false, false},
+		{"object and array", map[string]int64{"object": 2, "array": 1}, "object", "jsonb", true, true},
+		{"conflicting types", map[string]int64{"string": 2, "int": 1}, "string", "text", true, true},
+		{"only nulls", map[string]int64{"null": 4}, "null", "text", true, true},
+		{"only dotted keys", map[string]int64{}, "", "", false, false},
+	}
+	for _, tt := range tests {
+		p := &InferredPath{Path: "a", Types: tt.types}
+		p.resolve()
+		if p.MongoType != tt.mongoType || p.PgType != tt.pgType || p.mapped != tt.mapped || p.Ambiguous != tt.ambiguous {
+			t.Errorf("%s: got %s/%q mapped %v ambiguous %v (%s), want %s/%q mapped %v ambiguous %v", tt.name,
+				p.MongoType, p.PgType, p.mapped, p.Ambiguous, p.Reason, tt.mongoType, tt.pgType, tt.mapped, tt.ambiguous)
+		}
+	}
+}
+
+func TestPgName(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"name", "name"},
+		{"firstName", "first_name"},
+		{"address.zipCode", "address_zip_code"},
+		{"userID", "user_id"},
+		{"9lives", "_9lives"},
+		{"a-b", "a_b"},
+		{"Total Price", "total_price"},
+		{"_id", "_id"},
+	}
+	for _, tt := range tests {
+		if got := pgName(tt.path); got != tt.want {
+			t.Errorf("pgName(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestBelowLeaf(t *testing.T) {
+	leaves := map[string]bool{"tags": true, "owner.address": true}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"tags", false},
+		{"tags.0", true},
+		{"owner", false},
+		{"owner.name", false},
+		{"owner.address.city", true},
+		{"tagsx.a", false},
+	}
+	for _, tt := range tests {
+		if got := belowLeaf(leaves, tt.path); got != tt.want {
+			t.Errorf("belowLeaf(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
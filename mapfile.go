@@ -30,6 +30,7 @@ import (
 	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 func jsonToFieldsMap(s string) (fieldsMap, error) {
@@ -41,11 +42,30 @@ func jsonToFieldsMap(s string) (fieldsMap, error) {
 		return config, err
 	}
 	for k, v := range configDelayed {
-		db := dB{}
+		db := dB{PgSchema: v.PgSchema}
+		if db.PgSchema == "" {
+			db.PgSchema = defaultSchema
+		}
 		collections := collections{}
 		db.Collections = collections
 		for k, v := range v.Collections {
-			coll := coll{Name: v.Name, PgTable: v.PgTable}
+			// a collection without pg_schema uses the one of its database
+			coll := coll{Name: v.Name, PgSchema: v.PgSchema, PgTable: v.PgTable,
+				DeleteMode: strings.ToLower(v.DeleteMode), DeletedAtColumn: v.DeletedAtColumn, History: v.History,
+				ExtrasColumn: v.ExtrasColumn}
+			if coll.PgSchema == "" {
+				coll.PgSchema = db.PgSchema
+			}
+			switch coll.DeleteMode {
+			case "":
+				coll.DeleteMode = DeleteHard
+			case DeleteHard, DeleteSoft, DeleteIgnore:
+			default:
+				return nil, fmt.Errorf("unknown delete_mode %q of %s, use hard, soft or ignore", v.DeleteMode, k)
+			}
+			if coll.DeletedAtColumn == "" {
+				coll.DeletedAtColumn = defaultDeletedAtColumn
+			}
 			var fields1 fields
 			fields1, err = jsonToFields(string(v.Fields))
 			if err != nil {
@@ -53,6 +73,19 @@ func jsonToFieldsMap(s string) (fieldsMap, error) {
 				return nil, fmt.Errorf("unable to decode %w", err)
 			}
 			coll.Fields = fields1
+			if coll.ExtrasColumn != "" {
+				coll.Fields[extrasKey] = extrasField(coll.ExtrasColumn)
+			}
+			if coll.Children, err = jsonToChildren(v.Children, coll.PgSchema); err != nil {
+				log.Warnf("JSON Config decoding error: %s", err)
+				return nil, fmt.Errorf("unable to decode the children of %s: %w", k, err)
+			}
+			if len(v.Filter) > 0 {
+				if coll.Filter, err = jsonToFilter(v.Filter); err != nil {
+					log.Warnf("JSON Config decoding error: %s", err)
+					return nil, fmt.Errorf("unable to decode the filter of %s: %w", k, err)
+				}
+			}
 			db.Collections[k] = coll
 		}
 		config[k] = db
@@ -60,6 +93,15 @@ func jsonToFieldsMap(s string) (fieldsMap, error) {
 	return config, nil
 }
 
+// jsonToFilter decodes a mongo query written in extended JSON
+func jsonToFilter(raw json.RawMessage) (bson.M, error) {
+	filter := bson.M{}
+	if err := bson.UnmarshalExtJSON(raw, false, &filter); err != nil {
+		return nil, err
+	}
+	return filter, validateFilter(filter)
+}
+
 func jsonToFields(s string) (fields, error) {
 	var init fieldsWrapper
 	var err error
@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rwynn/gtm/v2"
+)
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// metricFamily is one metric name with its series, keyed by their rendered labels
+type metricFamily struct {
+	kind       string
+	help       string
+	counters   map[string]float64
+	histograms map[string]*histogram
+}
+
+// registry keeps the metrics of every sync and replication of the
+// process under stable names, MetricsHandler exposes them
+type registry struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+var metrics = newRegistry()
+
+func newRegistry() *registry {
+	r := &registry{families: make(map[string]*metricFamily)}
+	r.register("monresql_ops_read_total", "counter", "Ops read from mongo.")
+	r.register("monresql_ops_applied_total", "counter", "Ops written to postgres.")
+	r.register("monresql_ops_failed_total", "counter", "Ops that failed to be written and were dead lettered.")
+	r.register("monresql_ops_skipped_total", "counter", "Ops read from mongo that needed no write.")
+	r.register("monresql_postgres_write_seconds", "histogram", "Latency of the postgres writes.")
+	r.register("monresql_mongo_read_seconds", "histogram", "Latency of the mongo document reads.")
+	return r
+}
+
+func (r *registry) register(name, kind, help string) {
+	r.families[name] = &metricFamily{kind: kind, help: help, counters: make(map[string]float64), histograms: make(map[string]*histogram)}
+}
+
+// labels renders the name, value pairs in the exposition format
+func labels(pairs ...string) string {
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	parts := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], escape.Replace(pairs[i+1])))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (r *registry) inc(name string, pairs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families[name].counters[labels(pairs...)]++
+}
+
+func (r *registry) observe(name string, d time.Duration, pairs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	series := r.families[name].histograms
+	key := labels(pairs...)
+	h, ok := series[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		series[key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func withLabel(series, pair string) string {
+	if series == "" {
+		return pair
+	}
+	return series + "," + pair
+}
+
+// render writes the metrics in the prometheus text exposition format
+func (r *registry) render() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var b strings.Builder
+	names := []string{}
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := r.families[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, f.help, name, f.kind)
+		series := []string{}
+		for k := range f.counters {
+			series = append(series, k)
+		}
+		for k := range f.histograms {
+			series = append(series, k)
+		}
+		sort.Strings(series)
+		for _, key := range series {
+			if v, ok := f.counters[key]; ok {
+				fmt.Fprintf(&b, "%s{%s} %v\n", name, key, v)
+				continue
+			}
+			h := f.histograms[key]
+			for i, bound := range latencyBuckets {
+				fmt.Fprintf(&b, "%s_bucket{%s} %d\n", name, withLabel(key, labels("le", fmt.Sprint(bound))), h.counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket{%s} %d\n", name, withLabel(key, `le="+Inf"`), h.count)
+			fmt.Fprintf(&b, "%s_sum{%s} %v\n", name, key, h.sum)
+			fmt.Fprintf(&b, "%s_count{%s} %d\n", name, key, h.count)
+		}
+	}
+	return b.String()
+}
+
+// snapshot is the expvar view of the counters
+func (r *registry) snapshot() interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make(map[string]float64)
+	for name, f := range r.families {
+		for series, v := range f.counters {
+			out[name+"{"+series+"}"] = v
+		}
+	}
+	return out
+}
+
+var publishOnce sync.Once
+
+// publishExpvar publishes the counters once under the stable expvar name "monresql"
+func publishExpvar() {
+	publishOnce.Do(func() {
+		expvar.Publish("monresql", expvar.Func(metrics.snapshot))
+	})
+}
+
+// MetricsHandler serves the metrics of every sync and replication
+// of the process in the prometheus text format, mount it on /metrics
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprint(w, metrics.render())
+	})
+}
+
+// opName is the op label of a gtm op
+func opName(op *gtm.Op) string {
+	switch {
+	case op.IsInsert():
+		return "insert"
+	case op.IsUpdate():
+		return "update"
+	case op.IsDelete():
+		return "delete"
+	}
+	return op.Operation
+}
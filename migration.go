@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// migratable reports whether auto migrate may fix the issue, it only adds
+// tables, columns and indexes and widens a column to the mapped type
+func migratable(i ValidationIssue) bool {
+	switch i.Kind {
+	case IssueMissingTable, IssueMissingColumn, IssueMissingUniqueIndex:
+		return i.Suggestion != ""
+	case IssueTypeMismatch:
+		return i.Suggestion != "" && widens(i.Actual, i.Expected)
+	}
+	return false
+}
+
+// AutoMigrate brings the postgres tables up to the mapping: it creates the
+// missing tables, columns and unique indexes and widens the columns whose
+// mapped type holds all their values, like integer to bigint or varchar to
+// text. The changes and their records in metadataSchema.monresql_migrations are committed in
+// one transaction. Narrowing or incompatible type changes are left in the
+// returned report, it returns the applied issues too.
+func AutoMigrate(fieldMap fieldsMap, pg *sqlx.DB, metadataSchema string) (*ValidationReport, []ValidationIssue, error) {
+	report, err := CheckSchemaDrift(fieldMap, pg)
+	if err != nil {
+		return report, nil, err
+	}
+	applied := []ValidationIssue{}
+	for _, i := range report.Issues() {
+		if migratable(i) {
+			applied = append(applied, i)
+		}
+	}
+	if len(applied) == 0 {
+		return report, applied, nil
+	}
+	schema := metadataSchema
+	q := queries{}
+	if _, err := pg.Exec(q.CreateMigrationsTable(schema)); err != nil {
+		return report, nil, err
+	}
+	tx, err := pg.Beginx()
+	if err != nil {
+		return report, nil, err
+	}
+	defer tx.Rollback()
+	for _, i := range applied {
+		if _, err := tx.Exec(i.Suggestion); err != nil {
+			log.Errorf("Auto migrate of %s failed : %s", quoteTable(i.Schema, i.Table), err.Error())
+			return report, nil, err
+		}
+		if _, err := tx.Exec(q.SaveMigration(schema), i.Schema, i.Table, i.Column, i.Kind, i.Suggestion); err != nil {
+			return report, nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return report, nil, err
+	}
+	for _, i := range applied {
+		log.Infof("Auto migrate applied %s", i.Suggestion)
+	}
+	report, err = CheckSchemaDrift(fieldMap, pg)
+	return report, applied, err
+}
+
+// autoMigrate runs AutoMigrate before a replica or a sync starts writing,
+// the drift it can not fix is only logged as the writes may still succeed
+func autoMigrate(fieldMap fieldsMap, pg *sqlx.DB, metadataSchema string) error {
+	report, _, err := AutoMigrate(fieldMap, pg, metadataSchema)
+	if err != nil {
+		return err
+	}
+	for _, i := range report.Issues() {
+		log.Warnf("Schema drift left by auto migrate on %s %s : %s", quoteTable(i.Schema, i.Table), i.Column, i.Message)
+	}
+	return nil
+}
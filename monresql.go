@@ -37,14 +37,35 @@ API Reference
 LoadFieldsMap()
 Loads a mapping file to define how MongoDB documents should be mapped to PostgreSQL tables.
 
+InferFieldsMap()
+Samples the collections and infers the mapping file, flagging the paths of ambiguous types for review
+
 ValidateOrCreatePostgresTable()
 Validates the existence of a PostgreSQL table to ensure it's ready for data replication.
+and returns a ValidationReport, its SQL() renders the statements fixing the drift and Apply() runs them
+
+AutoMigrate()
+Adds the missing tables and columns, widens the columns to the mapped type and records every change in monresql_migrations
 
 Replicate()
 Initiates the data replication process from MongoDB to PostgreSQL based on the loaded mapping.
+and returns a ReplicateReport of the documents read, written and failed per collection
+
+ReplicateAndSync()
+Replicates then syncs from the position the oplog had when the replication started, so no change is missed
 
 Sync()
 Starts the synchronization process, ensuring that changes in MongoDB are reflected in PostgreSQL in real-time and also save the marker to sync from the last stopped mark if the service stopped
+and returns a SyncHandle to stop the sync and poll its Status()
+
+ReplayDeadLetters()
+Applies again the ops that failed to apply and were saved in the monresql_dead_letter table.
+
+MetricsHandler()
+Serves the read, write, failure and latency metrics of the syncs and replications in the Prometheus text format.
+
+NewReplicateOptions()
+NewReplicateOptions will return the options of Replicate, SetCopy(true) bulk loads the documents with COPY
 
 NewSyncOptions()
 NewSyncOptions will return the pointer of the syncoptions struct with default values of
@@ -57,17 +78,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"strings"
 	"sync"
-	"time"
 
 	"github.com/jmoiron/sqlx"
 	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-type syncStop func()
-
 // LoadFieldsMap receive the file as json string and return FieldsMap
 // please refer the moresql config file structure
 func LoadFieldsMap(jsonString string) (fieldsMap, error) {
@@ -80,32 +97,32 @@ func LoadFieldsMap(jsonString string) (fieldsMap, error) {
 }
 
 // ValidateOrCreatePostgresTable validates the postgres table fileds against the jsonfile, if table not
-// exists and it is a valid file it creates postgres table,
+// exists and it is a valid file it creates postgres table, its missing columns and the unique index on _id,
 // but you must create the Database yourself, always use the small letters in the postgres fields name
-// please refer the complex structure
-func ValidateOrCreatePostgresTable(fieldMap fieldsMap, pg *sqlx.DB) (string, error) {
-	cmd := commands{}
-	rsult := cmd.ValidateTablesAndColumns(fieldMap, pg)
-	query := strings.Join(rsult, "")
-	if len(rsult) > 0 {
-		_, err := pg.DB.Exec(query)
-		if err != nil {
-			fmt.Println("Table Creation Error ", err)
-			if strings.Contains(err.Error(), "already exists") {
-				return query, errors.New("all Postgres fields must be in lower case \n to resolve that use complex structure\n" + COMPLEX)
-			}
-			return query, errors.New(err.Error())
-		} else {
-			fmt.Println("Table Creation Done.")
-			rsult := cmd.ValidateTablesAndColumns(fieldMap, pg)
-			if len(rsult) > 0 {
-				query := strings.Join(rsult, "")
-				return query, errors.New("all Postgres fields must be in lower case \n to resolve that use complex structure\n" + COMPLEX)
-			}
+// please refer the complex structure.
+// Column types are never changed, the returned report lists what is left, the error is
+// the report itself when an issue still makes the writes fail. Use CheckSchemaDrift to
+// validate without changing the database.
+func ValidateOrCreatePostgresTable(fieldMap fieldsMap, pg *sqlx.DB) (*ValidationReport, error) {
+	report, err := CheckSchemaDrift(fieldMap, pg)
+	if err != nil {
+		return report, err
+	}
+	if len(report.MissingTables)+len(report.MissingColumns)+len(report.MissingIndexes) > 0 {
+		if err := report.applyCreates(pg); err != nil {
+			log.Errorf("Table Creation Error %s", err.Error())
+			return report, err
 		}
+		log.Info("Table Creation Done.")
+		if report, err = CheckSchemaDrift(fieldMap, pg); err != nil {
+			return report, err
+		}
+	}
+	if !report.OK() {
+		return report, report
 	}
-	fmt.Println("Table Validation Success.")
-	return "", nil
+	log.Info("Table Validation Success.")
+	return report, nil
 }
 
 const COMPLEX string = `"fieldName": {
@@ -114,31 +131,115 @@ const COMPLEX string = `"fieldName": {
 	      }`
 
 // if the table is validated you can start the replication using this method
-// please find sample  code in the example
-func Replicate(config fieldsMap, pg *sqlx.DB, mongo *mongo.Client, replicaName string) string {
+// please find sample  code in the example.
+// It returns a report of the documents read, written and failed per collection,
+// and a *ReplicateError when some were not replicated or ctx.Err() when
+// cancelled. The connections are left open for the caller.
+// A nil option replicates with the NewReplicateOptions defaults.
+// The progress of the scans is saved in monresql_snapshot_progress, a failed
+// or cancelled replication run again with the same replicaName skips the
+// collections already replicated and resumes the others after their last
+// written _id. The progress is forgotten once a replication succeeds.
+func Replicate(ctx context.Context, config fieldsMap, pg *sqlx.DB, mongo *mongo.Client, replicaName string, option *replicateOptions) (*ReplicateReport, error) {
 	var wg1 sync.WaitGroup
-	sync1 := newReplicater(config, pg, mongo, replicaName)
-	t := time.Now()
+	sync1 := newReplicater(config, pg, mongo, replicaName, option)
+	if sync1.option.autoMigrate {
+		if err := autoMigrate(config, pg, sync1.option.metadataSchema); err != nil {
+			return sync1.report, fmt.Errorf("unable to migrate the tables: %w", err)
+		}
+	}
+	ensureDeadLetterTable(pg, sync1.option.metadataSchema)
+	if err := sync1.deadLetters.load(pg); err != nil {
+		return sync1.report, fmt.Errorf("unable to load the dead letters of %s: %w", replicaName, err)
+	}
+	progressCtx, stopProgress := context.WithCancel(ctx)
+	go sync1.progress.run(progressCtx)
 	wg1.Add(2)
 	log.Println("Starting writer : " + replicaName)
-	go sync1.Write(&wg1)
+	go sync1.Write(ctx, &wg1)
 	log.Println("Starting reader : " + replicaName)
-	go sync1.Read(&wg1)
+	go sync1.Read(ctx, &wg1)
 	wg1.Wait()
-	log.Info("===============================Full Sync Completed For : ", replicaName, " Duration : ", time.Since(t))
-	defer pg.Close()
-	defer mongo.Disconnect(context.Background())
-	return "Replication Completed"
+	stopProgress()
+	if err := sync1.progress.save(); err != nil {
+		log.Errorf("Unable to save the progress of %s : %s", replicaName, err.Error())
+	}
+	report := sync1.report
+	report.finish()
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+	if !report.ok() {
+		return report, &ReplicateError{report}
+	}
+	if err := sync1.progress.clear(); err != nil {
+		log.Errorf("Unable to clear the progress of %s : %s", replicaName, err.Error())
+	}
+	log.Info("===============================Full Sync Completed For : ", replicaName, " Duration : ", report.Duration)
+	return report, nil
+}
+
+// NewSync prepares a sync without starting it, call Run on the handle to
+// sync until its context is cancelled
+func NewSync(fieldMap fieldsMap, pg *sqlx.DB, client *mongo.Client, syncName string, syncOption *syncOptions) *SyncHandle {
+	if syncOption == nil {
+		panic("syncOption not nil")
+	}
+	return &SyncHandle{t: newsyncronizer(fieldMap, pg, client, syncName, syncOption)}
 }
 
 // if the table is validated you can start the sync using this method
-// and it return a stop function, by using that method you can stop sync anytime
+// and it return a handle, use its Stop method to stop the sync anytime
+// and its Status method to know how the sync is doing.
+// Sync runs in the background, use NewSync and Run to get its error back
 // please find sample  code in the example
-func Sync(fieldMap fieldsMap, pg *sqlx.DB, client *mongo.Client, syncName string, syncOption *syncOptions) syncStop {
+func Sync(fieldMap fieldsMap, pg *sqlx.DB, client *mongo.Client, syncName string, syncOption *syncOptions) *SyncHandle {
+	h := NewSync(fieldMap, pg, client, syncName, syncOption)
+	h.start(context.Background())
+	return h
+}
+
+// ReplicateAndSync replicates the collections then syncs the changes made
+// since the replication started, without a gap. The position of the oplog
+// (or the change stream resume token) is read before the collections are
+// scanned and saved as the checkpoint of the sync, the changes replayed twice
+// are applied again by the same idempotent upserts.
+// The sync runs in the background until ctx is cancelled or Stop is called,
+// it is not started when the replication fails.
+func ReplicateAndSync(ctx context.Context, fieldMap fieldsMap, pg *sqlx.DB, client *mongo.Client, name string, replicateOption *replicateOptions, syncOption *syncOptions) (*SyncHandle, *ReplicateReport, error) {
 	if syncOption == nil {
 		panic("syncOption not nil")
 	}
-	service := newsyncronizer(fieldMap, pg, client, syncName, syncOption)
-	go service.serve()
-	return service.stop
+	if syncOption.lastEpoch != 0 {
+		return nil, nil, errors.New("SetLastEpoch can't be used with ReplicateAndSync, the sync starts where the replication started")
+	}
+	if err := syncOption.validate(); err != nil {
+		return nil, nil, err
+	}
+	h := NewSync(fieldMap, pg, client, name, syncOption)
+	// the sync can only start from this position if no collection was scanned before it
+	if replicateOption == nil {
+		replicateOption = NewReplicateOptions()
+	}
+	// the store creates and upgrades its table on Load, the checkpoint must be
+	// savable before the snapshot starts rather than once it is over
+	if _, err := h.t.store.Load(name); err != nil {
+		return nil, nil, fmt.Errorf("unable to load the checkpoint of %s: %w", name, err)
+	}
+	if err := newSnapshotProgress(pg, replicateOption.metadataSchema, name).clear(); err != nil {
+		return nil, nil, fmt.Errorf("unable to clear the progress of %s: %w", name, err)
+	}
+	position, err := h.t.snapshotPosition(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read the position of the oplog: %w", err)
+	}
+	report, err := Replicate(ctx, fieldMap, pg, client, name, replicateOption)
+	if err != nil {
+		return nil, report, err
+	}
+	if err := h.t.store.Save(position); err != nil {
+		return nil, report, fmt.Errorf("unable to save the checkpoint of %s: %w", name, err)
+	}
+	h.start(ctx)
+	return h, report, nil
 }
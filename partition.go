@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// minPartitionDocuments is the smallest range worth its own cursor
+const minPartitionDocuments = 10000
+
+// samplesPerPartition is how many sampled _ids a boundary is picked from
+const samplesPerPartition = 20
+
+// partitionRanges splits the collection in up to parallelism _id range
+// filters, the boundaries are picked from a sorted sample of the _ids.
+// The first range takes every _id not reaching the first boundary so the ids
+// of another BSON type than the boundaries are still scanned once.
+func partitionRanges(ctx context.Context, coll *mongo.Collection, parallelism int) ([]bson.M, error) {
+	whole := []bson.M{{}}
+	if parallelism <= 1 {
+		return whole, nil
+	}
+	count, err := coll.EstimatedDocumentCount(ctx)
+	if err != nil {
+		return whole, err
+	}
+	if limit := int(count / minPartitionDocuments); limit < parallelism {
+		parallelism = limit
+	}
+	if parallelism <= 1 {
+		return whole, nil
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$sample", Value: bson.M{"size": parallelism * samplesPerPartition}}},
+		{{Key: "$project", Value: bson.M{"_id": 1}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return whole, err
+	}
+	var samples []bson.Raw
+	if err := cursor.All(ctx, &samples); err != nil {
+		return whole, err
+	}
+	boundaries := []bson.RawValue{}
+	step := len(samples) / parallelism
+	for i := 1; i < parallelism && step > 0; i++ {
+		id := samples[i*step].Lookup("_id")
+		// the sample may hold the same _id twice
+		if len(boundaries) == 0 || !boundaries[len(boundaries)-1].Equal(id) {
+			boundaries = append(boundaries, id)
+		}
+	}
+	if len(boundaries) == 0 {
+		return whole, nil
+	}
+	ranges := []bson.M{{"_id": bson.M{"$not": bson.M{"$gte": boundaries[0]}}}}
+	for i := 0; i < len(boundaries)-1; i++ {
+		ranges = append(ranges, bson.M{"_id": bson.M{"$gte": boundaries[i], "$lt": boundaries[i+1]}})
+	}
+	ranges = append(ranges, bson.M{"_id": bson.M{"$gte": boundaries[len(boundaries)-1]}})
+	return ranges, nil
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// progressPeriod is how often the snapshot progress is saved
+const progressPeriod = time.Second * 5
+
+// partitionProgress is how far the scan of one _id range got. LastID is
+// only moved over a document once it and every document read before it
+// in the range was written or dead lettered.
+type partitionProgress struct {
+	ReplicaName string    `db:"replica_name"`
+	Namespace   string    `db:"namespace"`
+	Partition   int       `db:"partition"`
+	Bounds      string    `db:"bounds"`
+	LastID      string    `db:"last_id"`
+	Completed   bool      `db:"completed"`
+	UpdatedAt   time.Time `db:"updated_at"`
+
+	mark    *watermark
+	next    uint64
+	scanned int32
+}
+
+// filter is the range of the partition left to scan
+func (p *partitionProgress) filter() (bson.M, error) {
+	bounds := bson.M{}
+	if err := bson.UnmarshalExtJSON([]byte(p.Bounds), true, &bounds); err != nil {
+		return nil, err
+	}
+	if p.LastID == "" {
+		return bounds, nil
+	}
+	last := bson.M{}
+	if err := bson.UnmarshalExtJSON([]byte(p.LastID), true, &last); err != nil {
+		return nil, err
+	}
+	// $not also keeps the _ids of the other BSON types the scan hasn't reached
+	after := bson.M{"_id": bson.M{"$not": bson.M{"$lte": last["_id"]}}}
+	return bson.M{"$and": bson.A{bounds, after}}, nil
+}
+
+// track registers a document read by the scan, the returned ack is called
+// once the document is written
+func (p *partitionProgress) track(id bson.RawValue) func() {
+	seq := p.next
+	p.next++
+	// the cursor reuses its buffer
+	id = bson.RawValue{Type: id.Type, Value: append([]byte(nil), id.Value...)}
+	p.mark.track(seq, id)
+	return func() {
+		p.mark.complete(seq)
+	}
+}
+
+// snapshotProgress persists the progress of the partitions of a replication
+// in the monresql_snapshot_progress table
+type snapshotProgress struct {
+	pg         *sqlx.DB
+	schema     string
+	name       string
+	mu         sync.Mutex
+	partitions []*partitionProgress
+}
+
+func newSnapshotProgress(pg *sqlx.DB, schema, replicaName string) *snapshotProgress {
+	q := queries{}
+	if _, err := pg.Exec(q.CreateSnapshotProgressTable(schema)); err != nil {
+		log.Println("Snapshot progress table creating error : ", err)
+	}
+	return &snapshotProgress{pg: pg, schema: schema, name: replicaName}
+}
+
+// load returns the partitions a previous run of the replication saved for namespace
+func (s *snapshotProgress) load(namespace string) ([]*partitionProgress, error) {
+	q := queries{}
+	rows := []*partitionProgress{}
+	if err := s.pg.Select(&rows, q.GetSnapshotProgress(s.schema), s.name, namespace); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range rows {
+		p.mark = newWatermark()
+		if p.Completed {
+			atomic.StoreInt32(&p.scanned, 1)
+		}
+		s.partitions = append(s.partitions, p)
+	}
+	return rows, nil
+}
+
+// create registers the partitions of a namespace scanned for the first time
+func (s *snapshotProgress) create(namespace string, ranges []bson.M) ([]*partitionProgress, error) {
+	parts := []*partitionProgress{}
+	for i, r := range ranges {
+		bounds, err := bson.MarshalExtJSON(r, true, false)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, &partitionProgress{ReplicaName: s.name, Namespace: namespace, Partition: i,
+			Bounds: string(bounds), mark: newWatermark()})
+	}
+	s.mu.Lock()
+	s.partitions = append(s.partitions, parts...)
+	s.mu.Unlock()
+	return parts, s.save()
+}
+
+// save writes the progress of every partition
+func (s *snapshotProgress) save() error {
+	q := queries{}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.partitions {
+		if p.Completed {
+			continue
+		}
+		if last, ok := p.mark.get(); ok {
+			b, err := bson.MarshalExtJSON(bson.M{"_id": last}, true, false)
+			if err != nil {
+				return err
+			}
+			p.LastID = string(b)
+		}
+		p.Completed = atomic.LoadInt32(&p.scanned) == 1 && p.mark.pending() == 0
+		p.UpdatedAt = time.Now()
+		if _, err := s.pg.NamedExec(q.SaveSnapshotProgress(s.schema), p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run saves the progress periodically until ctx is done
+func (s *snapshotProgress) run(ctx context.Context) {
+	ticker := time.NewTicker(progressPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.save(); err != nil {
+				log.Errorf("Unable to save the progress of %s : %s", s.name, err.Error())
+			}
+		}
+	}
+}
+
+// clear forgets the progress of the replication so the next run starts over
+func (s *snapshotProgress) clear() error {
+	q := queries{}
+	_, err := s.pg.Exec(q.DeleteSnapshotProgress(s.schema), s.name)
+	return err
+}
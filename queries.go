@@ -22,43 +22,165 @@
 
 package monresql
 
+import "strings"
+
 // Queries contains the sql commands used by Monresql
 type queries struct{}
 
+// metadataTable fills the $SCHEMA and $TABLE placeholders of the metadata queries
+func (q *queries) metadataTable(query, schema, table string) string {
+	return strings.NewReplacer("$SCHEMA", schema, "$TABLE", table).Replace(query)
+}
+
 // GetMetadata fetches the most recent metadata row for this appname
-func (q *queries) GetMetadata() string {
-	return `SELECT * FROM monresql_metadata WHERE app_name=$1 ORDER BY last_epoch DESC LIMIT 1;`
+func (q *queries) GetMetadata(schema, table string) string {
+	return q.metadataTable(`SELECT * FROM "$SCHEMA"."$TABLE" WHERE app_name=$1 ORDER BY last_epoch DESC LIMIT 1;`, schema, table)
 }
 
 // SaveMetadata performs an upsert using metadata with uniqueness constraint on app_name
-func (q *queries) SaveMetadata() string {
-	return `INSERT INTO "monresql_metadata" ("app_name", "last_epoch", "processed_at")
-VALUES (:app_name, :last_epoch, :processed_at)
+func (q *queries) SaveMetadata(schema, table string) string {
+	return q.metadataTable(`INSERT INTO "$SCHEMA"."$TABLE" ("app_name", "last_epoch", "resume_token", "processed_at")
+VALUES (:app_name, :last_epoch, :resume_token, :processed_at)
 ON CONFLICT ("app_name")
-DO UPDATE SET "last_epoch" = :last_epoch, "processed_at" = :processed_at;`
+DO UPDATE SET "last_epoch" = :last_epoch, "resume_token" = :resume_token, "processed_at" = :processed_at;`, schema, table)
+}
+
+// AddResumeTokenColumn upgrades metadata tables created before change stream support
+func (q *queries) AddResumeTokenColumn(schema, table string) string {
+	return q.metadataTable(`ALTER TABLE "$SCHEMA"."$TABLE" ADD COLUMN IF NOT EXISTS resume_token TEXT NOT NULL DEFAULT '';`, schema, table)
 }
 
 // CreateMetadataTable provides the sql required to setup the metadata table
-func (q *queries) CreateMetadataTable() string {
-	return `
+func (q *queries) CreateMetadataTable(schema, table string) string {
+	return q.metadataTable(`
 -- create the monresql_metadata table for checkpoint persistance
-CREATE TABLE public.monresql_metadata
+CREATE TABLE "$SCHEMA"."$TABLE"
 (
     app_name TEXT NOT NULL,
     last_epoch INT NOT NULL,
+    resume_token TEXT NOT NULL DEFAULT '',
     processed_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
 );
 -- Setup mandatory unique index
-CREATE UNIQUE INDEX monresql_metadata_app_name_uindex ON public.monresql_metadata (app_name);
+CREATE UNIQUE INDEX "$TABLE_app_name_uindex" ON "$SCHEMA"."$TABLE" (app_name);
 
 -- Grant permissions to this user, replace username with moresql's user
-GRANT SELECT, UPDATE, DELETE ON TABLE public.monresql_metadata TO $USERNAME;
+GRANT SELECT, UPDATE, DELETE ON TABLE "$SCHEMA"."$TABLE" TO $USERNAME;
+
+COMMENT ON COLUMN "$SCHEMA"."$TABLE".app_name IS 'Name of application. Used for circumstances where multiple apps stream to same PG instance.';
+COMMENT ON COLUMN "$SCHEMA"."$TABLE".last_epoch IS 'Most recent epoch processed from Mongo';
+COMMENT ON COLUMN "$SCHEMA"."$TABLE".resume_token IS 'Change stream resume token of the most recent change processed from Mongo';
+COMMENT ON COLUMN "$SCHEMA"."$TABLE".processed_at IS 'Timestamp for when the last epoch was processed at';
+COMMENT ON TABLE "$SCHEMA"."$TABLE" IS 'Stores checkpoint data for Monresql (mongo->pg) streaming';
+`, schema, table)
+}
+
+// CreateDeadLetterTable provides the sql of the table keeping the ops that failed to apply
+func (q *queries) CreateDeadLetterTable(schema string) string {
+	return q.metadataTable(`
+CREATE TABLE IF NOT EXISTS "$SCHEMA".monresql_dead_letter
+(
+    id BIGSERIAL PRIMARY KEY,
+    app_name TEXT NOT NULL,
+    namespace TEXT NOT NULL,
+    doc_id TEXT NOT NULL,
+    op_type TEXT NOT NULL,
+    document JSONB,
+    sql_error TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 1,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
+);
+CREATE INDEX IF NOT EXISTS monresql_dead_letter_doc_index ON "$SCHEMA".monresql_dead_letter (app_name, namespace, doc_id);
+`, schema, "")
+}
+
+// SaveDeadLetter inserts the failed op
+func (q *queries) SaveDeadLetter(schema string) string {
+	return q.metadataTable(`INSERT INTO "$SCHEMA"."monresql_dead_letter" ("app_name", "namespace", "doc_id", "op_type", "document", "sql_error", "attempts")
+VALUES (:app_name, :namespace, :doc_id, :op_type, :document, :sql_error, :attempts);`, schema, "")
+}
+
+// GetDeadLetterDocs fetches the documents having dead letters under this appname
+func (q *queries) GetDeadLetterDocs(schema string) string {
+	return q.metadataTable(`SELECT DISTINCT namespace, doc_id FROM "$SCHEMA".monresql_dead_letter WHERE app_name=$1;`, schema, "")
+}
+
+// DeleteDocDeadLetters removes the dead letters of a document a later write superseded
+func (q *queries) DeleteDocDeadLetters(schema string) string {
+	return q.metadataTable(`DELETE FROM "$SCHEMA".monresql_dead_letter WHERE app_name=$1 AND namespace=$2 AND doc_id=$3;`, schema, "")
+}
+
+// GetDeadLetters fetches the failed ops of this appname in the order they were first dead lettered
+func (q *queries) GetDeadLetters(schema string) string {
+	return q.metadataTable(`SELECT * FROM "$SCHEMA".monresql_dead_letter WHERE app_name=$1 ORDER BY id;`, schema, "")
+}
+
+// DeleteDeadLetter removes a dead lettered op once it was replayed
+func (q *queries) DeleteDeadLetter(schema string) string {
+	return q.metadataTable(`DELETE FROM "$SCHEMA".monresql_dead_letter WHERE id=$1;`, schema, "")
+}
 
-COMMENT ON COLUMN public.monresql_metadata.app_name IS 'Name of application. Used for circumstances where multiple apps stream to same PG instance.';
-COMMENT ON COLUMN public.monresql_metadata.last_epoch IS 'Most recent epoch processed from Mongo';
-COMMENT ON COLUMN public.monresql_metadata.processed_at IS 'Timestamp for when the last epoch was processed at';
-COMMENT ON TABLE public.monresql_metadata IS 'Stores checkpoint data for Monresql (mongo->pg) streaming';
-`
+// FailDeadLetter records another failed replay of a dead lettered op
+func (q *queries) FailDeadLetter(schema string) string {
+	return q.metadataTable(`UPDATE "$SCHEMA".monresql_dead_letter SET sql_error=$2, attempts=attempts+1, updated_at=NOW() WHERE id=$1;`, schema, "")
+}
+
+// CreateSnapshotProgressTable provides the sql of the table keeping how far each _id range of a replication got
+func (q *queries) CreateSnapshotProgressTable(schema string) string {
+	return q.metadataTable(`
+CREATE TABLE IF NOT EXISTS "$SCHEMA".monresql_snapshot_progress
+(
+    replica_name TEXT NOT NULL,
+    namespace TEXT NOT NULL,
+    partition INT NOT NULL,
+    bounds TEXT NOT NULL,
+    last_id TEXT NOT NULL DEFAULT '',
+    completed BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS monresql_snapshot_progress_uindex ON "$SCHEMA".monresql_snapshot_progress (replica_name, namespace, partition);
+`, schema, "")
+}
+
+// GetSnapshotProgress fetches the partitions of a collection saved by a replication
+func (q *queries) GetSnapshotProgress(schema string) string {
+	return q.metadataTable(`SELECT * FROM "$SCHEMA".monresql_snapshot_progress WHERE replica_name=$1 AND namespace=$2 ORDER BY partition;`, schema, "")
+}
+
+// SaveSnapshotProgress upserts the progress of a partition
+func (q *queries) SaveSnapshotProgress(schema string) string {
+	return q.metadataTable(`INSERT INTO "$SCHEMA"."monresql_snapshot_progress" ("replica_name", "namespace", "partition", "bounds", "last_id", "completed", "updated_at")
+VALUES (:replica_name, :namespace, :partition, :bounds, :last_id, :completed, :updated_at)
+ON CONFLICT ("replica_name", "namespace", "partition")
+DO UPDATE SET "last_id" = :last_id, "completed" = :completed, "updated_at" = :updated_at;`, schema, "")
+}
+
+// DeleteSnapshotProgress forgets the progress of a finished replication
+func (q *queries) DeleteSnapshotProgress(schema string) string {
+	return q.metadataTable(`DELETE FROM "$SCHEMA".monresql_snapshot_progress WHERE replica_name=$1;`, schema, "")
+}
+
+// CreateMigrationsTable provides the sql of the table recording the schema changes auto migrate applied
+func (q *queries) CreateMigrationsTable(schema string) string {
+	return q.metadataTable(`
+CREATE TABLE IF NOT EXISTS "$SCHEMA".monresql_migrations
+(
+    id BIGSERIAL PRIMARY KEY,
+    table_schema TEXT NOT NULL,
+    table_name TEXT NOT NULL,
+    column_name TEXT NOT NULL DEFAULT '',
+    kind TEXT NOT NULL,
+    statement TEXT NOT NULL,
+    applied_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
+);
+`, schema, "")
+}
+
+// SaveMigration records a schema change applied by auto migrate
+func (q *queries) SaveMigration(schema string) string {
+	return q.metadataTable(`INSERT INTO "$SCHEMA".monresql_migrations ("table_schema", "table_name", "column_name", "kind", "statement")
+VALUES ($1, $2, $3, $4, $5);`, schema, "")
 }
 
 func (q *queries) GetColumnsFromTable() string {
@@ -96,7 +218,9 @@ WITH tables_and_indexes AS (
       WHEN p.contype = 'p'
         THEN TRUE
       ELSE FALSE
-      END                                             AS uniquekey
+      END                                             AS uniquekey,
+      -- ON CONFLICT needs a unique index on the column alone
+      COALESCE(ix.indisunique AND ix.indnatts = 1, FALSE) AS is_unique
     FROM pg_attribute f
       JOIN pg_class c ON c.oid = f.attrelid
       JOIN pg_type t ON t.oid = f.atttypid
@@ -108,7 +232,7 @@ WITH tables_and_indexes AS (
       LEFT JOIN pg_class AS i ON ix.indexrelid = i.oid
 
     WHERE c.relkind = 'r' :: CHAR
-          AND n.nspname = 'public'  -- Replace with Schema name
+          AND n.nspname = $3
           --AND c.relname = 'nodes'  -- Replace with table name, or Comment this for get all tables
           AND f.attnum > 0
     ORDER BY c.relname, f.attname
@@ -117,7 +241,40 @@ SELECT count(*) from tables_and_indexes
 WHERE "table" = $1
 AND "column" = $2
 AND is_index IS TRUE
--- TODO: determine how to check if index is unique vs unique column
--- AND uniquekey IS TRUE;
+AND is_unique IS TRUE;
 	`
 }
+
+// HasChildIndex tells whether a table has a unique index on exactly the columns $3 and $4, in this order
+func (q *queries) HasChildIndex() string {
+	return `
+SELECT EXISTS (
+  SELECT 1
+  FROM pg_index ix
+    JOIN pg_class t ON t.oid = ix.indrelid
+    JOIN pg_namespace n ON n.oid = t.relnamespace
+  WHERE n.nspname = $1
+    AND t.relname = $2
+    AND ix.indisunique
+    AND ix.indnatts = 2
+    AND (SELECT array_agg(a.attname::text ORDER BY k.ord)
+         FROM unnest(ix.indkey::int2[]) WITH ORDINALITY AS k(attnum, ord)
+           JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = k.attnum) = ARRAY[$3, $4]::text[]
+);`
+}
+
+// GetColumnTypes lists the columns of a table with their formatted type and nullability
+func (q *queries) GetColumnTypes() string {
+	return `
+SELECT a.attname                                       AS column_name,
+       pg_catalog.format_type(a.atttypid, a.atttypmod) AS data_type,
+       a.attnotnull                                    AS not_null
+FROM pg_attribute a
+  JOIN pg_class c ON c.oid = a.attrelid
+  JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE n.nspname = $1
+  AND c.relname = $2
+  AND a.attnum > 0
+  AND NOT a.attisdropped
+ORDER BY a.attnum;`
+}
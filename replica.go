@@ -24,9 +24,9 @@ package monresql
 
 import (
 	"context"
-	"expvar"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -36,82 +36,295 @@ import (
 	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 const workerCountOverflow = 500
 const workerCount = 5
 
+type replicateOptions struct {
+	copy            bool
+	copyBatchSize   int
+	copyWorkers     int
+	parallelism     int
+	collParallelism map[string]int
+	autoMigrate     bool
+	metadataSchema  string
+}
+
+// NewReplicateOptions return the pointer of the replicateOptions struct with default values of
+// &replicateOptions{copy: false, copyBatchSize: 10000, copyWorkers: 4, parallelism: 1}
+// then you can edit and change the values by set methods
+// SetCopy() load the documents with COPY through a staging table instead of one upsert per document
+// SetCopyBatchSize() how many documents of a collection are copied and merged at once
+// SetCopyWorkers() how many batches are loaded at the same time
+// SetScanParallelism() in how many _id ranges scanned concurrently a collection is split
+// SetCollectionScanParallelism() the same for one collection
+// SetMetadataSchema() the schema of monresql_snapshot_progress, monresql_dead_letter and monresql_migrations, public by default
+// SetAutoMigrate() add the missing tables and columns and widen the columns of the mapping before the replication starts
+func NewReplicateOptions() *replicateOptions {
+	return &replicateOptions{copyBatchSize: 10000, copyWorkers: 4, parallelism: 1, collParallelism: make(map[string]int),
+		metadataSchema: defaultSchema}
+}
+
+// SetCopy when true the documents are streamed with COPY FROM STDIN into an
+// unlogged staging table and merged into the table with a single upsert per batch
+func (r *replicateOptions) SetCopy(useCopy bool) {
+	r.copy = useCopy
+}
+
+// SetMetadataSchema is the schema the replication keeps its progress, dead
+// letters and migrations in, whatever the schemas of the mapped tables
+func (r *replicateOptions) SetMetadataSchema(schema string) {
+	r.metadataSchema = schema
+}
+
+// SetAutoMigrate when true Replicate runs AutoMigrate before it reads the collections
+func (r *replicateOptions) SetAutoMigrate(autoMigrate bool) {
+	r.autoMigrate = autoMigrate
+}
+
+// SetCopyBatchSize is how many documents of a collection are copied and merged in one transaction
+func (r *replicateOptions) SetCopyBatchSize(size int) {
+	r.copyBatchSize = size
+}
+
+// SetCopyWorkers is how many batches are copied at the same time
+func (r *replicateOptions) SetCopyWorkers(workers int) {
+	r.copyWorkers = workers
+}
+
+// SetScanParallelism splits every collection in up to parallelism _id ranges
+// scanned concurrently, small collections are scanned at once
+func (r *replicateOptions) SetScanParallelism(parallelism int) {
+	r.parallelism = parallelism
+}
+
+// SetCollectionScanParallelism overrides the scan parallelism of the collection
+// collection of the database db
+func (r *replicateOptions) SetCollectionScanParallelism(db, collection string, parallelism int) {
+	r.collParallelism[createFanKey(db, collection)] = parallelism
+}
+
+func (r *replicateOptions) scanParallelism(namespace string) int {
+	if p, ok := r.collParallelism[namespace]; ok {
+		return p
+	}
+	return r.parallelism
+}
+
 type replica struct {
 	Config      fieldsMap
 	Output      *sqlx.DB
 	Mongoclient *mongo.Client
 	C           chan dbResult
 	done        chan bool
+	name        string
+	report      *ReplicateReport
+	progress    *snapshotProgress
+	deadLetters *deadLetterIndex
+	option      *replicateOptions
+	tables      cmap.ConcurrentMap
 
 	insertCounter *ratecounter.RateCounter
 	readCounter   *ratecounter.RateCounter
 }
 
-func (z *replica) Read(wg1 *sync.WaitGroup) {
+func (z *replica) Read(ctx context.Context, wg1 *sync.WaitGroup) {
+	defer wg1.Done()
+	defer close(z.C)
 	for dbName, v := range z.Config {
 		db := z.Mongoclient.Database(dbName)
 		for name := range v.Collections {
-			coll := db.Collection(name)
-			ctx := context.Background()
-			defer ctx.Done()
-			cursor, err := coll.Find(ctx, bson.M{})
-			if err != nil {
-				log.Println("no cursor document found error on the find ", err)
+			if ctx.Err() != nil {
+				return
 			}
-			var result map[string]interface{}
-			for cursor.TryNext(ctx) {
-				if err = bson.Unmarshal(cursor.Current, &result); err != nil {
-					log.Println("unmarshal bson mongodb error : ", err)
-				} else {
-					z.readCounter.Incr(1)
-					z.C <- dbResult{dbName, name, result}
-					result = make(map[string]interface{})
-				}
+			z.readCollection(ctx, db.Collection(name))
+		}
+	}
+}
+
+// readCollection scans one collection into the writers channel, the _id
+// ranges of a partitioned collection are scanned concurrently
+func (z *replica) readCollection(ctx context.Context, coll *mongo.Collection) {
+	key := createFanKey(coll.Database().Name(), coll.Name())
+	report := z.report.Collections[key]
+	report.start()
+	parts, err := z.progress.load(key)
+	if err != nil {
+		log.Warnf("Unable to load the progress of %s, scanning it again : %s", key, err.Error())
+	}
+	if len(parts) == 0 {
+		ranges, err := partitionRanges(ctx, coll, z.option.scanParallelism(key))
+		if err != nil {
+			log.Warnf("Unable to partition %s, scanning it at once : %s", key, err.Error())
+			ranges = []bson.M{{}}
+		}
+		if parts, err = z.progress.create(key, ranges); err != nil {
+			log.Warnf("Unable to save the progress of %s : %s", key, err.Error())
+		}
+	} else {
+		log.Infof("Resuming the replication of %s", key)
+	}
+	var wg sync.WaitGroup
+	remaining := int32(0)
+	for _, p := range parts {
+		// Completed belongs to the progress goroutine, a loaded completed partition is marked scanned
+		if atomic.LoadInt32(&p.scanned) == 1 {
+			continue
+		}
+		remaining++
+		wg.Add(1)
+		go func(p *partitionProgress) {
+			defer wg.Done()
+			if z.scan(ctx, coll, p) {
+				atomic.AddInt32(&remaining, -1)
 			}
+		}(p)
+	}
+	wg.Wait()
+	if remaining == 0 {
+		report.scanned()
+	}
+}
+
+// scan reads the documents left in the range of the partition in _id order,
+// it returns true once it reached the end of the cursor
+func (z *replica) scan(ctx context.Context, coll *mongo.Collection, p *partitionProgress) bool {
+	dbName := coll.Database().Name()
+	key := createFanKey(dbName, coll.Name())
+	report := z.report.Collections[key]
+	filter, err := p.filter()
+	if err != nil {
+		log.Errorf("Unable to read the range of %s : %s", key, err.Error())
+		report.sample(err)
+		return false
+	}
+	c := z.Config[dbName].Collections[coll.Name()]
+	if len(c.Filter) > 0 {
+		filter = bson.M{"$and": bson.A{filter, c.Filter}}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	if projection := c.projection(); projection != nil {
+		opts.SetProjection(projection)
+	}
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		log.Errorf("Unable to scan %s : %s", key, err.Error())
+		report.sample(err)
+		return false
+	}
+	defer cursor.Close(context.Background())
+	labels := []string{"sync", z.name, "namespace", key, "op", "insert"}
+	for {
+		start := time.Now()
+		if !cursor.Next(ctx) {
+			break
+		}
+		metrics.observe("monresql_mongo_read_seconds", time.Since(start), labels[:4]...)
+		ack := p.track(cursor.Current.Lookup("_id"))
+		var result map[string]interface{}
+		if err = bson.Unmarshal(cursor.Current, &result); err != nil {
+			log.Println("unmarshal bson mongodb error : ", err)
+			report.read()
+			report.failed(err)
+			ack()
+			continue
+		}
+		z.readCounter.Incr(1)
+		report.read()
+		metrics.inc("monresql_ops_read_total", labels...)
+		select {
+		case z.C <- dbResult{dbName, coll.Name(), result, ack}:
+		case <-ctx.Done():
+			return false
 		}
 	}
-	close(z.C)
-	wg1.Done()
+	if err := cursor.Err(); err != nil {
+		log.Errorf("Scan of %s stopped : %s", key, err.Error())
+		report.sample(err)
+		return false
+	}
+	atomic.StoreInt32(&p.scanned, 1)
+	return true
 }
 
-func (z *replica) Write(wg1 *sync.WaitGroup) {
+func (z *replica) Write(ctx context.Context, wg1 *sync.WaitGroup) {
+	z.tables = z.buildTables()
+	if z.option.copy {
+		for i := 0; i < z.option.copyWorkers; i++ {
+			wg1.Add(1)
+			go z.copyWriter(ctx, i, wg1)
+		}
+		wg1.Done()
+		return
+	}
 	var workers [workerCountOverflow]int
-	tables := z.buildTables()
 	for range workers {
 		wg1.Add(1)
-		go z.writer(&tables, wg1)
+		go z.writer(ctx, wg1)
 	}
 	wg1.Done()
 }
 
-func (z *replica) writer(tables *cmap.ConcurrentMap, wg1 *sync.WaitGroup) {
+func (z *replica) writer(ctx context.Context, wg1 *sync.WaitGroup) {
+	defer wg1.Done()
 	for e := range z.C {
-		key := createFanKey(e.MongoDB, e.Collection)
-		v, ok := tables.Get(key)
-		if ok && !v.(bool) {
-			// Table doesn't exist, skip
-			break
+		z.upsert(ctx, e)
+	}
+}
+
+// upsert writes one document
+func (z *replica) upsert(ctx context.Context, e dbResult) {
+	key := createFanKey(e.MongoDB, e.Collection)
+	report := z.report.Collections[key]
+	v, ok := z.tables.Get(key)
+	if ok && !v.(bool) {
+		// Table doesn't exist, skip
+		report.failed(fmt.Errorf("table %s does not exist", e.Collection))
+		e.done()
+		return
+	}
+	o, coll := z.statementFromDbCollection(e.MongoDB, e.Collection)
+	op := buildOpFromMgo(o.mongoFields(), e, coll)
+	s := o.BuildUpsert()
+	labels := []string{"sync", z.name, "namespace", key, "op", "insert"}
+	start := time.Now()
+	err := withChildrenTx(ctx, z.Output, coll, func(ex sqlx.Ext) error {
+		if _, err := sqlx.NamedExec(ex, s, op.Data); err != nil {
+			return err
 		}
-		o, coll := z.statementFromDbCollection(e.MongoDB, e.Collection)
-		op := buildOpFromMgo(o.mongoFields(), e, coll)
-		s := o.BuildUpsert()
-		_, err := z.Output.NamedExec(s, op.Data)
-		z.insertCounter.Incr(1)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"description": err,
-			}).Error("Error")
-			if err.Error() == fmt.Sprintf(`pq: relation "%s" does not exist`, e.Collection) {
-				tables.Set(key, false)
-			}
+		if err := z.deadLetters.supersede(ex, key, op.Id); err != nil {
+			return err
+		}
+		if err := writeChildren(ex, coll, op.Id, e.Data, false, true); err != nil {
+			return err
+		}
+		// the versions of a snapshot are valid from the start of the replication
+		return writeHistory(ex, coll, op.Data, z.report.StartedAt, false, true)
+	})
+	metrics.observe("monresql_postgres_write_seconds", time.Since(start), labels...)
+	z.insertCounter.Incr(1)
+	if err == nil {
+		report.written()
+		metrics.inc("monresql_ops_applied_total", labels...)
+		e.done()
+	} else if ctx.Err() != nil {
+		// cancelled, the document is neither written nor failed
+	} else {
+		defer e.done()
+		report.failed(err)
+		metrics.inc("monresql_ops_failed_total", labels...)
+		log.WithFields(log.Fields{
+			"description": err,
+		}).Error("Error")
+		// keep the raw document rather than the sanitized row
+		failed := &gtm.Op{Id: op.Id, Operation: op.Operation, Namespace: key, Data: e.Data}
+		z.deadLetters.save(z.Output, failed, err, 1)
+		if err.Error() == fmt.Sprintf(`pq: relation "%s" does not exist`, e.Collection) {
+			z.tables.Set(key, false)
 		}
 	}
-	wg1.Done()
 }
 
 func (z *replica) statementFromDbCollection(db string, collectionName string) (statement, coll) {
@@ -138,22 +351,23 @@ func buildOpFromMgo(mongoFields []string, e dbResult, coll coll) *gtm.Op {
 	// Set to I so we are consistent about these beings inserts
 	// This avoids our guardclause in sanitize
 	opRef.Operation = "i"
-	data := sanitizeData(coll.Fields, opRef)
+	data := coll.sanitize(opRef)
 	opRef.Data = data
 	return opRef
 }
 
-func newReplicater(config fieldsMap, pg *sqlx.DB, mongo *mongo.Client, replicaName string) replica {
+func newReplicater(config fieldsMap, pg *sqlx.DB, mongo *mongo.Client, replicaName string, option *replicateOptions) replica {
 	c := make(chan dbResult)
 	insertCounter := ratecounter.NewRateCounter(1 * time.Second)
 	readCounter := ratecounter.NewRateCounter(1 * time.Second)
-	time := fmt.Sprint(time.Now())
-	insert := "insert/sec " + replicaName + time
-	read := "read/sec " + replicaName + time
-	log.Info("inserted value :", insert, read, replicaName)
-	expvar.Publish(insert, insertCounter)
-	expvar.Publish(read, readCounter)
+	publishExpvar()
 	done := make(chan bool, 2)
-	sync := replica{config, pg, mongo, c, done, insertCounter, readCounter}
+	if option == nil {
+		option = NewReplicateOptions()
+	}
+	sync := replica{Config: config, Output: pg, Mongoclient: mongo, C: c, done: done, name: replicaName,
+		report: newReplicateReport(replicaName, config), progress: newSnapshotProgress(pg, option.metadataSchema, replicaName), option: option,
+		deadLetters:   newDeadLetterIndex(option.metadataSchema, replicaName),
+		insertCounter: insertCounter, readCounter: readCounter}
 	return sync
 }
@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sampleErrors is how many errors are kept per collection in a report
+const sampleErrors = 10
+
+// ReplicateReport summarizes a replication
+type ReplicateReport struct {
+	Name        string
+	StartedAt   time.Time
+	Duration    time.Duration
+	Collections map[string]*CollectionReport
+}
+
+// CollectionReport counts the documents of one collection replication,
+// Complete is false when its scan stopped before the end of the collection
+// and Errors keeps the first errors it hit
+type CollectionReport struct {
+	Namespace string
+	Read      int64
+	Written   int64
+	Failed    int64
+	Complete  bool
+	Errors    []string
+	Duration  time.Duration
+
+	mu        sync.Mutex
+	startedAt time.Time
+	doneAt    time.Time
+}
+
+// ReplicateError is returned by Replicate when documents were not replicated,
+// the report tells which collections and why
+type ReplicateError struct {
+	Report *ReplicateReport
+}
+
+func (e *ReplicateError) Error() string {
+	read, failed := e.Report.totals()
+	incomplete := 0
+	for _, c := range e.Report.Collections {
+		if !c.Complete {
+			incomplete++
+		}
+	}
+	return fmt.Sprintf("replication %s failed %d of %d documents read, %d collections not fully read", e.Report.Name, failed, read, incomplete)
+}
+
+func newReplicateReport(name string, config fieldsMap) *ReplicateReport {
+	r := &ReplicateReport{Name: name, StartedAt: time.Now(), Collections: make(map[string]*CollectionReport)}
+	for dbName, db := range config {
+		for collectionName := range db.Collections {
+			key := createFanKey(dbName, collectionName)
+			r.Collections[key] = &CollectionReport{Namespace: key}
+		}
+	}
+	return r
+}
+
+// Namespaces lists the collections of the report in order
+func (r *ReplicateReport) Namespaces() []string {
+	keys := []string{}
+	for k := range r.Collections {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ok is true when every collection was fully read and written
+func (r *ReplicateReport) ok() bool {
+	for _, c := range r.Collections {
+		if !c.Complete || atomic.LoadInt64(&c.Failed) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *ReplicateReport) totals() (read int64, failed int64) {
+	for _, c := range r.Collections {
+		read += atomic.LoadInt64(&c.Read)
+		failed += atomic.LoadInt64(&c.Failed)
+	}
+	return
+}
+
+// finish computes the durations once the readers and writers are done
+func (r *ReplicateReport) finish() {
+	r.Duration = time.Since(r.StartedAt)
+	for _, c := range r.Collections {
+		c.mu.Lock()
+		if !c.startedAt.IsZero() && c.doneAt.After(c.startedAt) {
+			c.Duration = c.doneAt.Sub(c.startedAt)
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *CollectionReport) start() {
+	c.mu.Lock()
+	c.startedAt = time.Now()
+	c.doneAt = c.startedAt
+	c.mu.Unlock()
+}
+
+// done moves the end of the collection replication forward
+func (c *CollectionReport) done() {
+	c.mu.Lock()
+	c.doneAt = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *CollectionReport) read() {
+	atomic.AddInt64(&c.Read, 1)
+}
+
+func (c *CollectionReport) written() {
+	atomic.AddInt64(&c.Written, 1)
+	c.done()
+}
+
+func (c *CollectionReport) failed(err error) {
+	atomic.AddInt64(&c.Failed, 1)
+	c.sample(err)
+}
+
+// sample keeps the error if the report has room for it
+func (c *CollectionReport) sample(err error) {
+	c.mu.Lock()
+	if len(c.Errors) < sampleErrors {
+		c.Errors = append(c.Errors, err.Error())
+	}
+	c.doneAt = time.Now()
+	c.mu.Unlock()
+}
+
+// scanned marks the collection as read to its end
+func (c *CollectionReport) scanned() {
+	c.mu.Lock()
+	c.Complete = true
+	c.mu.Unlock()
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// retryPolicy decides how often a failed postgres write is tried again
+type retryPolicy struct {
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	classes     []string
+}
+
+// defaultRetryClasses are the SQLSTATE classes of errors that usually go away by
+// themselves: connection exceptions, serialization failures and deadlocks,
+// insufficient resources and server shutdowns
+var defaultRetryClasses = []string{"08", "40", "53", "57P"}
+
+func newRetryPolicy() retryPolicy {
+	return retryPolicy{maxAttempts: 5, baseBackoff: time.Millisecond * 100, maxBackoff: time.Second * 10, classes: defaultRetryClasses}
+}
+
+// sqlState is implemented by the errors of lib/pq and pgx
+type sqlState interface {
+	SQLState() string
+}
+
+// retryable reports whether err has one of the policy SQLSTATE classes, a lost
+// connection without SQLSTATE counts as class 08
+func (r *retryPolicy) retryable(err error) bool {
+	code := ""
+	var state sqlState
+	var netErr net.Error
+	switch {
+	case errors.As(err, &state):
+		code = state.SQLState()
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED), errors.As(err, &netErr):
+		code = "08000"
+	}
+	if code == "" {
+		return false
+	}
+	for _, class := range r.classes {
+		if strings.HasPrefix(code, class) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff doubles the base backoff on every attempt up to the max backoff
+func (r *retryPolicy) backoff(attempt int) time.Duration {
+	d := r.baseBackoff
+	for i := 1; i < attempt && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+	return d
+}
+
+// do runs fn until it succeeds, fails with an error that is not retryable or
+// runs out of attempts. It returns the number of attempts made and the last error.
+func (r *retryPolicy) do(ctx context.Context, fn func() error) (int, error) {
+	attempt := 1
+	for {
+		err := fn()
+		if err == nil || attempt >= r.maxAttempts || !r.retryable(err) {
+			return attempt, err
+		}
+		select {
+		case <-time.After(r.backoff(attempt)):
+		case <-ctx.Done():
+			return attempt, err
+		}
+		attempt++
+	}
+}
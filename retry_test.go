@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+type stateError string
+
+func (e stateError) Error() string    { return "sql error " + string(e) }
+func (e stateError) SQLState() string { return string(e) }
+
+func TestRetryable(t *testing.T) {
+	r := newRetryPolicy()
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"serialization failure", stateError("40001"), true},
+		{"deadlock", stateError("40P01"), true},
+		{"connection failure", stateError("08006"), true},
+		{"too many connections", stateError("53300"), true},
+		{"admin shutdown", stateError("57P01"), true},
+		{"query canceled", stateError("57014"), false},
+		{"unique violation", stateError("23505"), false},
+		{"undefined column", stateError("42703"), false},
+		{"wrapped", fmt.Errorf("batch: %w", stateError("40001")), true},
+		{"bad connection", driver.ErrBadConn, true},
+		{"eof", io.EOF, true},
+		{"plain error", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.retryable(tt.err); got != tt.want {
+				t.Fatalf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryableClasses(t *testing.T) {
+	r := retryPolicy{classes: []string{"23505"}}
+	if !r.retryable(stateError("23505")) {
+		t.Fatal("retryable(23505) = false with class 23505")
+	}
+	if r.retryable(stateError("40001")) {
+		t.Fatal("retryable(40001) = true without class 40")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	r := retryPolicy{baseBackoff: 100 * time.Millisecond, maxBackoff: time.Second}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+	}
+	for _, tt := range tests {
+		if got := r.backoff(tt.attempt); got != tt.want {
+			t.Fatalf("backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDo(t *testing.T) {
+	r := retryPolicy{maxAttempts: 3, baseBackoff: time.Millisecond, maxBackoff: time.Millisecond, classes: defaultRetryClasses}
+	calls := 0
+	attempts, err := r.do(context.Background(), func() error {
+		calls++
+		if calls < 2 {
+			return stateError("40001")
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("do() = %d, %v, want 2, nil", attempts, err)
+	}
+	attempts, err = r.do(context.Background(), func() error { return stateError("40001") })
+	if err == nil || attempts != 3 {
+		t.Fatalf("do() = %d, %v, want 3 attempts and the error", attempts, err)
+	}
+	attempts, _ = r.do(context.Background(), func() error { return stateError("23505") })
+	if attempts != 1 {
+		t.Fatalf("do() = %d attempts, want 1 for a permanent error", attempts)
+	}
+}
@@ -90,7 +90,15 @@ func (o *statement) buildAssignment() string {
 			set = append(set, fmt.Sprintf(`%s = :%s`, v.Postgres.nameQuoted(), v.Postgres.Name))
 		}
 	}
-	return strings.Join(set, ", ")
+	return strings.Join(append(set, o.clearTombstone()...), ", ")
+}
+
+// clearTombstone revives a soft deleted row when its document is written again
+func (o *statement) clearTombstone() []string {
+	if o.Collection.DeleteMode != DeleteSoft {
+		return nil
+	}
+	return []string{fmt.Sprintf(`"%s" = NULL`, o.Collection.DeletedAtColumn)}
 }
 
 func (o *statement) buildUpdateAssignment(fields []string) string {
@@ -131,6 +139,38 @@ func (o *statement) BuildUpsert() string {
 	return output
 }
 
+// buildExcludedAssignment sets every column from the conflicting row of an INSERT ... SELECT
+func (o *statement) buildExcludedAssignment() string {
+	set := []string{}
+	for _, k := range o.sortedKeys() {
+		v := o.Collection.Fields[k]
+		if k != "_id" {
+			set = append(set, fmt.Sprintf(`%s = EXCLUDED.%s`, v.Postgres.nameQuoted(), v.Postgres.nameQuoted()))
+		}
+	}
+	return strings.Join(append(set, o.clearTombstone()...), ", ")
+}
+
+// BuildStaging creates the unlogged table a bulk load is copied into before it is merged
+func (o *statement) BuildStaging(stage string) string {
+	return fmt.Sprintf(`CREATE UNLOGGED TABLE IF NOT EXISTS %s (LIKE %s INCLUDING DEFAULTS);`, stage, o.Collection.pgTableQuoted())
+}
+
+// BuildCopy is the COPY statement lib/pq streams the rows of a bulk load with
+func (o *statement) BuildCopy(stage string) string {
+	return fmt.Sprintf(`COPY %s (%s) FROM STDIN`, stage, strings.Join(o.postgresFieldsQuoted(), ", "))
+}
+
+// BuildMerge upserts the rows of the staging table into the table
+func (o *statement) BuildMerge(stage string) string {
+	columns := strings.Join(o.postgresFieldsQuoted(), ", ")
+	insertInto := fmt.Sprintf("INSERT INTO %s (%s)", o.Collection.pgTableQuoted(), columns)
+	selectFrom := fmt.Sprintf(`SELECT %s FROM %s`, columns, stage)
+	onConflict := fmt.Sprintf("ON CONFLICT (%s)", o.id().Postgres.nameQuoted())
+	doUpdate := fmt.Sprintf("DO UPDATE SET %s;", o.buildExcludedAssignment())
+	return o.joinLines(insertInto, selectFrom, onConflict, doUpdate)
+}
+
 func (o *statement) BuildInsert() string {
 	insertInto := fmt.Sprintf("INSERT INTO %s (%s)", o.Collection.pgTableQuoted(), strings.Join(o.postgresFieldsQuoted(), ", "))
 	values := fmt.Sprintf("VALUES (%s)", o.joinedPlaceholders())
@@ -148,3 +188,77 @@ func (o *statement) BuildUpdate(fields []string) string {
 func (o *statement) BuildDelete() string {
 	return fmt.Sprintf("DELETE FROM %s %s;", o.Collection.pgTableQuoted(), o.whereById())
 }
+
+// BuildHistoryClose ends the open version of the document at the timestamp of the op
+func (o *statement) BuildHistoryClose() string {
+	update := fmt.Sprintf("UPDATE %s", o.Collection.historyTableQuoted())
+	set := fmt.Sprintf(`SET "%s" = :%s`, validToColumn, validTsParam)
+	where := fmt.Sprintf(`%s AND "%s" IS NULL AND "%s" < :%s;`, o.whereById(), validToColumn, validFromColumn, validTsParam)
+	return o.joinLines(update, set, where)
+}
+
+// BuildHistoryInsert opens a version of the document unless one is still open
+// or one starts at or after the timestamp of the op. The values are cast to
+// the mapped types as an INSERT ... SELECT does not infer them.
+func (o *statement) BuildHistoryInsert() string {
+	values := []string{}
+	for _, k := range o.sortedKeys() {
+		v := o.Collection.Fields[k]
+		values = append(values, fmt.Sprintf("CAST(:%s AS %s)", v.Postgres.Name, v.Postgres.Type))
+	}
+	values = append(values, fmt.Sprintf("CAST(:%s AS timestamp with time zone)", validTsParam))
+	columns := append(o.postgresFieldsQuoted(), fmt.Sprintf(`"%s"`, validFromColumn))
+	insertInto := fmt.Sprintf("INSERT INTO %s (%s)", o.Collection.historyTableQuoted(), strings.Join(columns, ", "))
+	selectValues := fmt.Sprintf("SELECT %s", strings.Join(values, ", "))
+	where := fmt.Sprintf(`WHERE NOT EXISTS (SELECT 1 FROM %s %s AND ("%s" IS NULL OR "%s" >= :%s));`,
+		o.Collection.historyTableQuoted(), o.whereById(), validToColumn, validFromColumn, validTsParam)
+	return o.joinLines(insertInto, selectValues, where)
+}
+
+// BuildSoftDelete marks the row deleted and keeps it
+func (o *statement) BuildSoftDelete() string {
+	return fmt.Sprintf(`UPDATE %s SET "%s" = NOW() %s;`, o.Collection.pgTableQuoted(), o.Collection.DeletedAtColumn, o.whereById())
+}
+
+// BuildRemove is the statement of a mongo delete in the delete mode of the
+// collection, empty when deletes are ignored
+func (o *statement) BuildRemove() string {
+	switch o.Collection.DeleteMode {
+	case DeleteSoft:
+		return o.BuildSoftDelete()
+	case DeleteIgnore:
+		return ""
+	}
+	return o.BuildDelete()
+}
+
+// childStatement builds the sql replacing the rows of a child table
+type childStatement struct {
+	Child child
+}
+
+func (o *childStatement) sortedKeys() []string {
+	var keys []string
+	for k := range o.Child.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (o *childStatement) BuildDelete() string {
+	return fmt.Sprintf(`DELETE FROM %s WHERE "%s" = :%s;`, o.Child.pgTableQuoted(), o.Child.ParentKey, o.Child.ParentKey)
+}
+
+func (o *childStatement) BuildInsert() string {
+	columns := []string{fmt.Sprintf(`"%s"`, o.Child.ParentKey), fmt.Sprintf(`"%s"`, o.Child.IndexColumn)}
+	placeholders := []string{":" + o.Child.ParentKey, ":" + o.Child.IndexColumn}
+	for _, k := range o.sortedKeys() {
+		v := o.Child.Fields[k]
+		columns = append(columns, v.Postgres.nameQuoted())
+		placeholders = append(placeholders, ":"+v.Postgres.Name)
+	}
+	insertInto := fmt.Sprintf("INSERT INTO %s (%s)", o.Child.pgTableQuoted(), strings.Join(columns, ", "))
+	values := fmt.Sprintf("VALUES (%s);", strings.Join(placeholders, ", "))
+	return strings.Join([]string{insertInto, values}, "\n")
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rwynn/gtm/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// SyncState is the lifecycle state of a sync
+type SyncState string
+
+const (
+	SyncStarting     SyncState = "starting"
+	SyncRunning      SyncState = "running"
+	SyncReconnecting SyncState = "reconnecting"
+	SyncStopped      SyncState = "stopped"
+)
+
+// SyncStatus is a snapshot of a running sync, returned by SyncHandle.Status
+type SyncStatus struct {
+	Name  string
+	State SyncState
+	// LastAppliedAt is the oplog time of the latest op written to postgres
+	LastAppliedAt time.Time
+	// LagMs is how far behind mongo the sync is, 0 when no op is waiting
+	LagMs int64
+	// QueueDepths is the number of ops queued per mongo namespace, or under
+	// SharedQueue for the single queue of the transactional mode
+	QueueDepths map[string]int
+	LastError   error
+	LastErrorAt time.Time
+}
+
+// SharedQueue is the QueueDepths key of the queue all the namespaces share in the transactional mode
+const SharedQueue = "*"
+
+// syncStatus is the mutable part of SyncStatus, updated by the reader and the workers
+type syncStatus struct {
+	mu          sync.Mutex
+	state       SyncState
+	lastApplied time.Time
+	lastErr     error
+	lastErrAt   time.Time
+}
+
+func (s *syncStatus) setState(state SyncState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+}
+
+func (s *syncStatus) setError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastErr = err
+	s.lastErrAt = time.Now()
+}
+
+// recovered sets a reconnecting sync back to running once ops flow again
+func (s *syncStatus) recovered() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == SyncReconnecting {
+		s.state = SyncRunning
+	}
+}
+
+// applied moves the last applied time forward, the workers finish out of order
+func (s *syncStatus) applied(op *gtm.Op) {
+	ts := time.Unix(int64(op.Timestamp.T), 0)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ts.After(s.lastApplied) {
+		s.lastApplied = ts
+	}
+}
+
+// SyncHandle controls a sync created with NewSync or started with Sync
+type SyncHandle struct {
+	t      *syncronizer
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// begin marks the sync as started, a sync can only run once
+func (h *SyncHandle) begin(ctx context.Context) (context.Context, chan struct{}, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.done != nil {
+		return nil, nil, fmt.Errorf("sync %s was already started", h.t.syncName)
+	}
+	ctx, h.cancel = context.WithCancel(ctx)
+	h.done = make(chan struct{})
+	return ctx, h.done, nil
+}
+
+// start runs the sync in the background, logging the error that stopped it
+func (h *SyncHandle) start(ctx context.Context) {
+	ctx, done, err := h.begin(ctx)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	go func() {
+		defer close(done)
+		if err := h.t.run(ctx); err != nil {
+			log.Errorf("Sync %s stopped : %s", h.t.syncName, err.Error())
+		}
+	}()
+}
+
+// Run syncs until ctx is cancelled, Stop is called or a fatal error occurs.
+// On the way out it stops reading, waits for the ops already read to be
+// applied and saves a final checkpoint. It returns nil on a clean shutdown
+// and the fatal error otherwise.
+func (h *SyncHandle) Run(ctx context.Context) error {
+	ctx, done, err := h.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer close(done)
+	return h.t.run(ctx)
+}
+
+// Stop stops the sync and waits until it has shut down, it can be called
+// more than once
+func (h *SyncHandle) Stop() {
+	h.mu.Lock()
+	cancel, done := h.cancel, h.done
+	h.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// Status reports the state, progress and last error of the sync,
+// it is cheap enough to be polled by readiness probes
+func (h *SyncHandle) Status() SyncStatus {
+	t := h.t
+	t.status.mu.Lock()
+	status := SyncStatus{
+		Name:          t.syncName,
+		State:         t.status.state,
+		LastAppliedAt: t.status.lastApplied,
+		LastError:     t.status.lastErr,
+		LastErrorAt:   t.status.lastErrAt,
+		QueueDepths:   make(map[string]int),
+	}
+	t.status.mu.Unlock()
+	for k, c := range t.fan {
+		if t.setting.transactional {
+			// every namespace shares the queue of the single writer
+			status.QueueDepths[SharedQueue] = len(c)
+			break
+		}
+		status.QueueDepths[k] = len(c)
+	}
+	if t.checkpoint.pending() > 0 && !status.LastAppliedAt.IsZero() {
+		status.LagMs = msLag(status.LastAppliedAt, time.Now)
+	}
+	return status
+}
+
+func msLag(ts time.Time, nowFunc func() time.Time) int64 {
+	return nowFunc().Sub(ts).Milliseconds()
+}
@@ -25,12 +25,24 @@ package monresql
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 type dbResult struct {
 	MongoDB    string
 	Collection string
 	Data       map[string]interface{}
+	// ack tells the reader the document was written or dead lettered
+	ack func()
+}
+
+func (d dbResult) done() {
+	if d.ack != nil {
+		d.ack()
+	}
 }
 
 type columnResult struct {
@@ -47,11 +59,11 @@ type tableColumn struct {
 }
 
 func (t *tableColumn) uniqueIndex() string {
-	return fmt.Sprintf("CREATE UNIQUE INDEX %s_service_uindex_on_%s ON %s.%s (%s);", t.Table, t.Column, t.Schema, t.Table, t.Column)
+	return fmt.Sprintf(`CREATE UNIQUE INDEX %s_service_uindex_on_%s ON %s (%s);`, t.Table, t.Column, quoteTable(t.Schema, t.Table), t.Column)
 }
 
 func (t *tableColumn) createColumn() string {
-	return fmt.Sprintf(`ALTER TABLE %s.%s ADD %s %s NULL;`, t.Schema, t.Table, normalizeDotNotationToPostgresNaming(t.Column), t.Type)
+	return fmt.Sprintf(`ALTER TABLE %s ADD %s %s NULL;`, quoteTable(t.Schema, t.Table), normalizeDotNotationToPostgresNaming(t.Column), t.Type)
 }
 
 // hasUniqueIndex
@@ -90,25 +102,109 @@ type (
 )
 
 type coll struct {
-	Name    string `json:"name"`
-	PgTable string `json:"pg_table"`
-	Fields  fields `json:"fields"`
+	Name     string   `json:"name"`
+	PgSchema string   `json:"pg_schema"`
+	PgTable  string   `json:"pg_table"`
+	Fields   fields   `json:"fields"`
+	Filter   bson.M   `json:"filter"`
+	Children children `json:"children"`
+	// DeleteMode is what a mongo delete does to the row, see the delete modes
+	DeleteMode      string `json:"delete_mode"`
+	DeletedAtColumn string `json:"deleted_at_column"`
+	// History keeps every version of the documents in <pg_table>_history
+	History bool `json:"history"`
+	// ExtrasColumn receives the unmapped top level keys of the documents as a JSONB object
+	ExtrasColumn string `json:"extras_column"`
+}
+
+// The delete modes of a collection
+const (
+	// DeleteHard deletes the row, the default
+	DeleteHard = "hard"
+	// DeleteSoft keeps the row and sets its deleted at column
+	DeleteSoft = "soft"
+	// DeleteIgnore keeps the row untouched
+	DeleteIgnore = "ignore"
+)
+
+const defaultDeletedAtColumn = "deleted_at"
+
+// tableFields are the columns of the table of the collection, the mapped
+// fields and the deleted at column of the soft delete mode
+func (c coll) tableFields() fields {
+	if c.DeleteMode != DeleteSoft {
+		return c.Fields
+	}
+	f := fields{}
+	for k, v := range c.Fields {
+		f[k] = v
+	}
+	f["$deleted_at"] = field{Postgres: postgresDB{Name: c.DeletedAtColumn, Type: "timestamp with time zone"}}
+	return f
 }
 
 func (c coll) pgTableQuoted() string {
-	return fmt.Sprintf(`"%s"`, c.PgTable)
+	return quoteTable(c.PgSchema, c.PgTable)
+}
+
+// defaultSchema is the schema of the tables without a pg_schema
+const defaultSchema = "public"
+
+// quoteTable qualifies the table with its schema
+func quoteTable(schema, table string) string {
+	if schema == "" {
+		schema = defaultSchema
+	}
+	return fmt.Sprintf(`"%s"."%s"`, schema, table)
+}
+
+// matches reports whether the document passes the filter of the collection
+func (c coll) matches(doc map[string]interface{}) bool {
+	return len(c.Filter) == 0 || matchFilter(doc, c.Filter)
+}
+
+// projection only reads the mapped fields, a path below another mapped path is left out.
+// The whole document is read when the unmapped keys go to the extras column.
+func (c coll) projection() bson.M {
+	if c.ExtrasColumn != "" {
+		return nil
+	}
+	paths := c.Children.paths()
+	for k := range c.Fields {
+		paths = append(paths, k)
+	}
+	sort.Strings(paths)
+	projection := bson.M{"_id": 1}
+	last := ""
+	for _, p := range paths {
+		if last != "" && strings.HasPrefix(p, last+".") {
+			continue
+		}
+		projection[p] = 1
+		last = p
+	}
+	return projection
 }
 
 type collectionDelayed struct {
-	Name    string          `json:"name"`
-	PgTable string          `json:"pg_table"`
-	Fields  json.RawMessage `json:"fields"`
+	Name            string          `json:"name"`
+	PgSchema        string          `json:"pg_schema"`
+	PgTable         string          `json:"pg_table"`
+	Fields          json.RawMessage `json:"fields"`
+	Filter          json.RawMessage `json:"filter"`
+	Children        childrenDelayed `json:"children"`
+	DeleteMode      string          `json:"delete_mode"`
+	DeletedAtColumn string          `json:"deleted_at_column"`
+	History         bool            `json:"history"`
+	ExtrasColumn    string          `json:"extras_column"`
 }
 
 type dBDelayed struct {
+	PgSchema    string             `json:"pg_schema"`
 	Collections collectionsDelayed `json:"collections"`
 }
 type dB struct {
+	PgSchema    string      `json:"pg_schema"`
 	Collections collections `json:"collections"`
 }
 
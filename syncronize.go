@@ -24,15 +24,13 @@ package monresql
 
 import (
 	"context"
-	"database/sql"
-	"expvar"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	cmap "github.com/orcaman/concurrent-map"
 	"github.com/paulbellamy/ratecounter"
 	"github.com/rwynn/gtm/v2"
 	"github.com/serialx/hashring"
@@ -45,17 +43,19 @@ import (
 // Tailer is the core struct for performing
 // Mongo->Pg streaming.
 type syncronizer struct {
-	syncName     string
-	pg           *sqlx.DB
-	mgoClient    *mongo.Client
-	counters     counters
-	stopC        chan bool
-	fan          map[string]gtm.OpChan
-	checkpoint   *cmap.ConcurrentMap
-	psqluserName string
-	fieldMap     fieldsMap
-	setting      *syncOptions
-	ctxCancel    context.CancelFunc
+	syncName   string
+	pg         *sqlx.DB
+	mgoClient  *mongo.Client
+	counters   counters
+	fatalC     chan error
+	fan        map[string]gtm.OpChan
+	checkpoint *watermark
+	store      CheckpointStore
+	status     *syncStatus
+	fieldMap   fieldsMap
+	setting    *syncOptions
+	// deadLetters are the documents with dead letters
+	deadLetters *deadLetterIndex
 }
 
 type syncOptions struct {
@@ -63,6 +63,17 @@ type syncOptions struct {
 	checkPointPeriod time.Duration
 	lastEpoch        int64
 	reportPeriod     time.Duration
+	changeStream     bool
+	transactional    bool
+	batchSize        int
+	batchPeriod      time.Duration
+	fullDocument     bool
+	retry            retryPolicy
+	store            CheckpointStore
+	closeConnections bool
+	drainTimeout     time.Duration
+	autoMigrate      bool
+	metadataSchema   string
 }
 
 // NewSyncOptions method return the pointer of syncOptions with default values of
@@ -72,8 +83,20 @@ type syncOptions struct {
 // SetCheckPointPeriod() the marker saving period interval
 // SetLastEpoch() if you want run the sync from the known epoch time you can use this method and restart the service
 // SetReportPeriod() it log out the read and write counts in the console
+// SetChangeStream() read the changes from a MongoDB change stream and resume from its token instead of tailing the oplog
+// SetTransactional() commit every micro batch of ops together with its checkpoint in one postgres transaction
+// SetBatchSize() and SetBatchPeriod() bound the micro batch of the transactional mode
+// SetFullDocumentUpdates() re-read the whole document on every update instead of applying only the changed fields
+// SetCheckpointStore() where the checkpoints are kept, monresql_metadata in the metadata schema by default
+// SetCloseConnections() close the postgres and mongo connections when the sync stops, they are left to the caller by default
+// SetDrainTimeout() how long a stopping sync waits for the ops already read to be applied, 1 minute by default
+// SetMetadataSchema() the schema of monresql_metadata, monresql_dead_letter and monresql_migrations, public by default
+// SetAutoMigrate() add the missing tables and columns and widen the columns of the mapping before the sync starts
+// SetRetryPolicy() how often a write failing with a transient postgres error is retried, by default 5 attempts from 100ms up to 10s apart
 func NewSyncOptions() *syncOptions {
-	return &syncOptions{checkpoint: true, checkPointPeriod: time.Minute * 1, lastEpoch: 0, reportPeriod: time.Minute * 1}
+	return &syncOptions{checkpoint: true, checkPointPeriod: time.Minute * 1, lastEpoch: 0, reportPeriod: time.Minute * 1,
+		batchSize: 500, batchPeriod: time.Second * 1, retry: newRetryPolicy(), drainTimeout: time.Minute * 1,
+		metadataSchema: defaultSchema}
 }
 
 func (s *syncOptions) SetCheckPoint(checkpoint bool) {
@@ -91,26 +114,176 @@ func (s *syncOptions) SetReportPeriod(duration time.Duration) {
 	s.reportPeriod = duration
 }
 
-// Serve is the func necessary to start action
-// when using Suture library
-func (t *syncronizer) serve() {
-	fmt.Println("sync serve called")
-	ctx, cancel := context.WithCancel(context.Background())
-	t.ctxCancel = cancel
-	t.write(ctx)
-	t.read(ctx)
-	t.report(ctx)
-	t.checkpoints(ctx)
-	<-t.stopC
+// SetChangeStream when true the sync watches a change stream and saves the
+// resume token with the checkpoint, so a restart resumes exactly after the
+// last processed change. SetLastEpoch still wins over the saved token.
+func (s *syncOptions) SetChangeStream(changeStream bool) {
+	s.changeStream = changeStream
 }
 
-// Stop is the func necessary to terminate action
-func (t *syncronizer) stop() {
-	fmt.Println("stop called........................")
-	t.ctxCancel()
-	t.pg.Close()
-	t.mgoClient.Disconnect(context.Background())
-	t.stopC <- true
+// SetTransactional when true a single writer applies the ops in micro batches,
+// each batch and its monresql_metadata upsert are committed in the same
+// transaction so a crash can neither lose nor replay an applied op.
+// It needs SetChangeStream: the sync refuses to start without it, with
+// SetLastEpoch or from a checkpoint without a resume token, as an epoch
+// only counts seconds and resuming from it replays the ops of the last one.
+func (s *syncOptions) SetTransactional(transactional bool) {
+	s.transactional = transactional
+}
+
+// validate rejects the combinations of options the sync can't honour
+func (s *syncOptions) validate() error {
+	if !s.transactional {
+		return nil
+	}
+	if !s.changeStream {
+		return errors.New("the transactional mode needs SetChangeStream, resuming from an epoch replays the ops of its last second")
+	}
+	if s.lastEpoch != 0 {
+		return errors.New("the transactional mode resumes from the resume token, SetLastEpoch would replay the ops of its second")
+	}
+	return nil
+}
+
+// SetBatchSize is the maximum number of ops committed in one transaction
+func (s *syncOptions) SetBatchSize(size int) {
+	s.batchSize = size
+}
+
+// SetBatchPeriod is the longest time an op waits for its batch to fill up
+func (s *syncOptions) SetBatchPeriod(duration time.Duration) {
+	s.batchPeriod = duration
+}
+
+// SetFullDocumentUpdates when true every update reads the document again from
+// its collection and upserts all the columns. By default an update only sets the
+// columns of the changed fields, read from the update description of a change
+// stream or from the $set/$unset or $v:2 diff of an oplog entry. An array diff
+// or a replacement is applied as a whole document.
+func (s *syncOptions) SetFullDocumentUpdates(fullDocument bool) {
+	s.fullDocument = fullDocument
+}
+
+// SetCheckpointStore selects where the checkpoints are saved and loaded, see
+// NewPostgresCheckpointStore, NewFileCheckpointStore and NewMemoryCheckpointStore.
+// The transactional mode only commits the checkpoint with its batch in a postgres store.
+func (s *syncOptions) SetCheckpointStore(store CheckpointStore) {
+	s.store = store
+}
+
+// SetCloseConnections when true the sync closes the postgres and mongo
+// connections it was given once it stops
+func (s *syncOptions) SetCloseConnections(closeConnections bool) {
+	s.closeConnections = closeConnections
+}
+
+// SetDrainTimeout is how long a stopping sync waits for the workers to apply
+// the ops already read before it saves its final checkpoint
+func (s *syncOptions) SetDrainTimeout(duration time.Duration) {
+	s.drainTimeout = duration
+}
+
+// SetMetadataSchema is the schema the sync keeps its checkpoints, dead letters
+// and migrations in. It doesn't depend on the schemas of the mapped tables, so
+// changing the mapping never moves the checkpoint of a running sync.
+func (s *syncOptions) SetMetadataSchema(schema string) {
+	s.metadataSchema = schema
+}
+
+// SetAutoMigrate when true the sync runs AutoMigrate before it starts, so the
+// fields added to the mapping get their columns instead of failing every upsert
+func (s *syncOptions) SetAutoMigrate(autoMigrate bool) {
+	s.autoMigrate = autoMigrate
+}
+
+// SetRetryPolicy retries a write failing with one of the SQLSTATE classes, or a
+// prefix of a code like "40P01", up to maxAttempts times with an exponential
+// backoff from baseBackoff to maxBackoff. Without classes the connection,
+// transaction rollback, insufficient resources and shutdown errors are retried.
+// The worker holding the op waits for it, so the later ops of the same document
+// and the checkpoint stay behind it. An op still failing is dead lettered, when
+// its dead letter can't be saved either the sync stops with a fatal error.
+func (s *syncOptions) SetRetryPolicy(maxAttempts int, baseBackoff, maxBackoff time.Duration, sqlStateClasses ...string) {
+	if len(sqlStateClasses) == 0 {
+		sqlStateClasses = defaultRetryClasses
+	}
+	s.retry = retryPolicy{maxAttempts: maxAttempts, baseBackoff: baseBackoff, maxBackoff: maxBackoff, classes: sqlStateClasses}
+}
+
+// run syncs until ctx is done or a fatal error occurs. It then stops reading,
+// lets the workers finish the ops already read and saves a final checkpoint.
+func (t *syncronizer) run(ctx context.Context) error {
+	defer t.status.setState(SyncStopped)
+	if err := t.setting.validate(); err != nil {
+		t.status.setError(err)
+		return err
+	}
+	if t.setting.closeConnections {
+		defer t.mgoClient.Disconnect(context.Background())
+		defer t.pg.Close()
+	}
+	if err := t.pg.PingContext(ctx); err != nil {
+		t.status.setError(err)
+		return fmt.Errorf("unable to reach postgres: %w", err)
+	}
+	if t.setting.autoMigrate {
+		if err := autoMigrate(t.fieldMap, t.pg, t.setting.metadataSchema); err != nil {
+			t.status.setError(err)
+			return fmt.Errorf("unable to migrate the tables: %w", err)
+		}
+	}
+	// the workers outlive the reader so they can drain the queues
+	workCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	readCtx, stopReading := context.WithCancel(ctx)
+	defer stopReading()
+	t.write(workCtx)
+	readDone := make(chan struct{})
+	if err := t.read(readCtx, readDone); err != nil {
+		t.status.setError(err)
+		return err
+	}
+	t.status.setState(SyncRunning)
+	t.report(workCtx)
+	t.checkpoints(workCtx)
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-t.fatalC:
+		t.status.setError(err)
+		log.Errorf("Sync %s stopping on fatal error : %s", t.syncName, err.Error())
+	}
+	stopReading()
+	<-readDone
+	t.drain()
+	stopWorkers()
+	if t.setting.checkpoint {
+		if latest, ok := t.checkpoint.get(); ok {
+			t.saveCheckpoint(latest.(Checkpoint))
+		}
+	}
+	return err
+}
+
+// fail stops the sync with a fatal error
+func (t *syncronizer) fail(err error) {
+	select {
+	case t.fatalC <- err:
+	default:
+	}
+}
+
+// drain waits until the workers finished every op read, at most the drain timeout
+func (t *syncronizer) drain() {
+	deadline := time.Now().Add(t.setting.drainTimeout)
+	for t.checkpoint.pending() > 0 {
+		if time.Now().After(deadline) {
+			log.Warnf("Sync %s stopped with %d ops not applied, they are replayed on restart", t.syncName, t.checkpoint.pending())
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
 }
 
 func (t *syncronizer) startOverflowConsumers(c <-chan *gtm.Op, ctx context.Context) {
@@ -121,10 +294,19 @@ func (t *syncronizer) startOverflowConsumers(c <-chan *gtm.Op, ctx context.Conte
 
 func (t *syncronizer) newFan() map[string]gtm.OpChan {
 	fan := make(map[string]gtm.OpChan)
+	// The transactional writer keeps the oplog order, so every collection shares its channel
+	var shared gtm.OpChan
+	if t.setting.transactional {
+		shared = make(gtm.OpChan, 1000)
+	}
 	// Register Channels
 	for dbName, db := range t.fieldMap {
 		for collectionName := range db.Collections {
-			fan[createFanKey(dbName, collectionName)] = make(gtm.OpChan, 1000)
+			if shared != nil {
+				fan[createFanKey(dbName, collectionName)] = shared
+			} else {
+				fan[createFanKey(dbName, collectionName)] = make(gtm.OpChan, 1000)
+			}
 		}
 	}
 	return fan
@@ -143,7 +325,11 @@ func (t *syncronizer) newOptions(timestamp epochTimestamp, replayDuration time.D
 	options.After = after
 	options.BufferSize = 500
 	options.BufferDuration = time.Duration(500 * time.Millisecond)
-	options.Ordering = gtm.Document
+	// the watermark numbers the ops in read order, so they must be read in
+	// oplog order or a checkpoint could pass an op still buffered in gtm
+	options.Ordering = gtm.Oplog
+	// updates are read from the oplog entry and only fetched when they can't be applied partially
+	options.UpdateDataAsDelta = true
 	return options, nil
 }
 
@@ -161,7 +347,7 @@ func (t *syncronizer) startDedicatedConsumers(fan map[string]gtm.OpChan, overflo
 			keys = append(keys, k)
 		}
 		ring := hashring.New(keys)
-		go consistentBroker(c, ring, workerPool, ctx)
+		go consistentBroker(c, ring, workerPool, t.checkpoint, ctx)
 		for _, workerChan := range workerPool {
 			go t.consumer(workerChan, overflow, ctx)
 		}
@@ -175,7 +361,7 @@ func (t *syncronizer) startDedicatedConsumers(fan map[string]gtm.OpChan, overflo
 type epochTimestamp int64
 
 func buildOptionAfterFromTimestamp(timestamp epochTimestamp, replayDuration time.Duration) func(*mongo.Client, *gtm.Options) (primitive.Timestamp, error) {
-	if timestamp != epochTimestamp(0) && int64(timestamp) < time.Now().Unix() {
+	if timestamp != epochTimestamp(0) && int64(timestamp) <= time.Now().Unix() {
 		// We have a starting oplog entry
 		f := func() time.Time { return time.Unix(int64(timestamp), 0) }
 		return opTimestampWrapper(f, time.Duration(0))
@@ -186,13 +372,14 @@ func buildOptionAfterFromTimestamp(timestamp epochTimestamp, replayDuration time
 	}
 }
 
-func consistentBroker(in gtm.OpChan, ring *hashring.HashRing, workerPool map[string]gtm.OpChan, ctx context.Context) {
+func consistentBroker(in gtm.OpChan, ring *hashring.HashRing, workerPool map[string]gtm.OpChan, checkpoint *watermark, ctx context.Context) {
 	for {
 		select {
 		case op := <-in:
 			node, ok := ring.GetNode(fmt.Sprintf("%s", op.Id))
 			if !ok {
 				log.Error("Failed at getting worker node from hashring")
+				checkpoint.complete(op)
 			} else {
 				out := workerPool[node]
 				out <- op
@@ -203,8 +390,17 @@ func consistentBroker(in gtm.OpChan, ring *hashring.HashRing, workerPool map[str
 	}
 }
 
-func (t *syncronizer) read(ctx context.Context) {
-	metadata := fetchMetadata(t.pg, t.syncName, t.psqluserName)
+// read loads the checkpoint and starts fanning the ops out to the workers
+// until ctx is done, done is closed once it stopped reading
+func (t *syncronizer) read(ctx context.Context, done chan struct{}) error {
+	metadata, err := t.store.Load(t.syncName)
+	if err != nil {
+		return fmt.Errorf("unable to load the checkpoint of %s: %w", t.syncName, err)
+	}
+	ensureDeadLetterTable(t.pg, t.setting.metadataSchema)
+	if err := t.deadLetters.load(t.pg); err != nil {
+		return fmt.Errorf("unable to load the dead letters of %s: %w", t.syncName, err)
+	}
 
 	var lastEpoch int64
 	if t.setting.lastEpoch != 0 {
@@ -212,78 +408,126 @@ func (t *syncronizer) read(ctx context.Context) {
 	} else {
 		lastEpoch = metadata.LastEpoch
 	}
-	options, err := t.newOptions(epochTimestamp(lastEpoch), 0)
-	if err != nil {
-		log.Println(err.Error())
+	if t.setting.transactional && metadata.ResumeToken == "" && metadata.LastEpoch != 0 {
+		return fmt.Errorf("the checkpoint of %s has no resume token, the transactional mode can't resume from its epoch without replaying ops", t.syncName)
+	}
+	var g gtmTail
+	if t.setting.changeStream {
+		token := metadata.ResumeToken
+		if t.setting.lastEpoch != 0 {
+			token = ""
+		}
+		g = t.watch(ctx, token, lastEpoch)
+	} else {
+		g = t.tailOplog(lastEpoch)
 	}
-	ops, errs := gtm.Tail(t.mgoClient, options)
-	g := gtmTail{ops, errs}
 	// log.Info("Tailing mongo oplog")
 	go func() {
+		defer close(done)
+		defer func() {
+			if g.stop != nil {
+				g.stop()
+			}
+		}()
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			case err := <-g.errs:
-				if strings.Contains("i/o timeout", err.Error()) {
-					// Restart gtm.Tail
-					// Close existing channels to not leak resources
+				t.status.setError(err)
+				t.status.setState(SyncReconnecting)
+				if t.setting.changeStream {
+					// the change stream reopens itself from the last resume token
+					log.Errorf("Change stream error, resuming : %s", err.Error())
+				} else if strings.Contains(err.Error(), "i/o timeout") {
+					// Restart the oplog tailing
+					// Stop the existing tail to not leak resources
 					log.Errorf("Problem connecting to mongo initiating reconnection: %s", err.Error())
-					close(g.ops)
-					close(g.errs)
-					latest, ok := t.checkpoint.Get(t.syncName)
-					if ok && latest != nil {
-						metadata = latest.(monresqlMetadata)
+					latest, ok := t.checkpoint.get()
+					if ok {
+						g.stop()
+						metadata = latest.(Checkpoint)
 						lastEpoch = metadata.LastEpoch
-						options, err := t.newOptions(epochTimestamp(lastEpoch), 0)
-						if err != nil {
-							log.Println(err.Error())
-						}
-						ops, errs = gtm.Tail(t.mgoClient, options)
-						g = gtmTail{ops, errs}
+						g = t.tailOplog(lastEpoch)
 					} else {
 						log.Printf("Exiting: Unable to recover from %s", err.Error())
+						t.fail(fmt.Errorf("unable to recover the oplog tailer: %w", err))
 					}
 				} else {
 					log.Printf("Exiting: Mongo tailer returned error %s", err.Error())
-					// if t.retryCount == 0 {
-					// 	Stop(t.syncName)
-					// } else {
-					// 	t.retryCount--
-					// }
+					t.fail(fmt.Errorf("mongo tailer returned error: %w", err))
 				}
 			case op := <-g.ops:
-				t.counters.read.Incr(1)
-				log.WithFields(log.Fields{
-					"operation":  op.Operation,
-					"collection": op.GetCollection(),
-					"id":         op.Id,
-				}).Debug("Received operation")
-				// Check if we're watching for the collection
-				db := op.GetDatabase()
-				coll := op.GetCollection()
-				key := createFanKey(db, coll)
-				if c := t.fan[key]; c != nil {
-					collection := t.fieldMap[db].Collections[coll]
-					o := statement{collection}
-					c <- ensureOpHasAllFields(op, o.mongoFields())
-				} else {
-					t.counters.skipped.Incr(1)
-					log.Debug("Missing channel for this collection")
-				}
-				for k, v := range t.fan {
-					if len(v) > 0 {
-						log.Debugf("Channel %s has %d", k, len(v))
-					}
-				}
+				t.dispatch(op)
 			}
 		}
 	}()
+	return nil
+}
+
+// dispatch tracks the op and sends it to the channel of its collection, the
+// ops of the unmapped collections are completed right away. The document is
+// sent as read: a placeholder for a missing field would exist for the filter
+// and hide the operators of an oplog update, sanitize fills the columns.
+func (t *syncronizer) dispatch(op *gtm.Op) {
+	t.status.recovered()
+	t.counters.read.Incr(1)
+	metrics.inc("monresql_ops_read_total", t.opLabels(op)...)
+	log.WithFields(log.Fields{
+		"operation":  op.Operation,
+		"collection": op.GetCollection(),
+		"id":         op.Id,
+	}).Debug("Received operation")
+	// Check if we're watching for the collection
+	key := createFanKey(op.GetDatabase(), op.GetCollection())
+	// every op is tracked so the checkpoint can also move over skipped ones
+	t.checkpoint.track(op, t.opToCheckpoint(op))
+	if c := t.fan[key]; c != nil {
+		c <- op
+	} else {
+		t.checkpoint.complete(op)
+		t.counters.skipped.Incr(1)
+		metrics.inc("monresql_ops_skipped_total", t.opLabels(op)...)
+		log.Debug("Missing channel for this collection")
+	}
+	for k, v := range t.fan {
+		if len(v) > 0 {
+			log.Debugf("Channel %s has %d", k, len(v))
+		}
+	}
+}
+
+// tailOplog starts tailing the oplog from lastEpoch
+func (t *syncronizer) tailOplog(lastEpoch int64) gtmTail {
+	options, err := t.newOptions(epochTimestamp(lastEpoch), 0)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	gtmCtx := gtm.Start(t.mgoClient, options)
+	stop := func() {
+		// gtm only stops once its blocked sends went through
+		go func() {
+			for range gtmCtx.OpC {
+			}
+		}()
+		go func() {
+			for range gtmCtx.ErrC {
+			}
+		}()
+		gtmCtx.Stop()
+	}
+	return gtmTail{gtmCtx.OpC, gtmCtx.ErrC, stop}
 }
 
 func (t *syncronizer) write(ctx context.Context) {
-	t.fan = t.newFan()
 	log.WithField("struct", t.fan).Debug("Fan")
+	if t.setting.transactional {
+		for _, c := range t.fan {
+			go t.transactionalConsumer(c, ctx)
+			break
+		}
+		return
+	}
 	overflow := make(gtm.OpChan)
 	t.startDedicatedConsumers(t.fan, overflow, ctx)
 	t.startOverflowConsumers(overflow, ctx)
@@ -304,32 +548,37 @@ func (t *syncronizer) report(ctx context.Context) {
 	}()
 }
 
-func (t *syncronizer) saveCheckpoint(m monresqlMetadata) error {
+func (t *syncronizer) saveCheckpoint(m Checkpoint) error {
 	// log.Println("save check point called")
-	q := queries{}
-	result, err := t.pg.NamedExec(q.SaveMetadata(), m)
+	err := t.store.Save(m)
 	if err != nil {
-		log.Errorf("Unable to save into moresql_metadata: %+v, %+v", result, err.Error())
+		t.status.setError(err)
+		log.Errorf("Unable to save checkpoint: %+v", err.Error())
 	}
 	return err
 }
 
 func (t *syncronizer) checkpoints(ctx context.Context) {
+	if t.setting.transactional || !t.setting.checkpoint {
+		// transactional batches commit their own checkpoint
+		return
+	}
 	go func() {
 		// log.Println("this is checkpoint frequency ", checkpointFrequency, "for this tailname : ", t.tailName)
 		timer := time.NewTicker(t.setting.checkPointPeriod)
-		var epoch int64 = 0
+		var saved Checkpoint
 		for {
 			select {
 			case <-timer.C:
-				latest, ok := t.checkpoint.Get(t.syncName)
-				if ok && latest != nil {
-					data := latest.(monresqlMetadata)
-					if epoch != data.LastEpoch {
+				// only the low watermark is saved, every op before it is applied
+				latest, ok := t.checkpoint.get()
+				if ok {
+					data := latest.(Checkpoint)
+					if saved.LastEpoch != data.LastEpoch || saved.ResumeToken != data.ResumeToken {
 						t.saveCheckpoint(data)
 						log.Printf("Checkpoint Saved : \"%s\" epoch : %d", data.AppName, data.LastEpoch)
 					}
-					epoch = data.LastEpoch
+					saved = data
 				}
 			case <-ctx.Done():
 				return
@@ -352,74 +601,200 @@ func (t *syncronizer) consumer(in <-chan *gtm.Op, overflow chan<- *gtm.Op, ctx c
 		}
 		select {
 		case op := <-in:
-			t.processOp(op)
-			if t.setting.checkpoint {
-				t.checkpoint.Set(t.syncName, t.opTomonresqlMetadata(op))
+			if err := t.processOp(op, ctx); err != nil {
+				// the op stays in flight, the checkpoint can't move past it
+				t.fail(err)
+				return
 			}
+			t.status.applied(op)
+			t.checkpoint.complete(op)
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (t *syncronizer) opTomonresqlMetadata(op *gtm.Op) monresqlMetadata {
+func (t *syncronizer) opToCheckpoint(op *gtm.Op) Checkpoint {
 	ts, _ := gtm.ParseTimestamp(op.Timestamp)
-	return monresqlMetadata{AppName: t.syncName, ProcessedAt: time.Now(), LastEpoch: int64(ts)}
+	token, _ := op.ResumeToken.ResumeToken.(string)
+	return Checkpoint{AppName: t.syncName, ProcessedAt: time.Now(), LastEpoch: int64(ts), ResumeToken: token}
 }
 
-func (t *syncronizer) getMongoDocById(id interface{}) map[string]interface{} {
+// getMongoDocById reads the current version of the document from the op's own
+// collection, it returns nil when the document is gone
+func (t *syncronizer) getMongoDocById(dbName, collectionName string, id interface{}) map[string]interface{} {
 	var result map[string]interface{}
-	for dbName, v := range t.fieldMap {
-		db := t.mgoClient.Database(dbName)
-		for name := range v.Collections {
-			coll := db.Collection(name)
-			ctx := context.Background()
-			defer ctx.Done()
-			mongoResult := coll.FindOne(ctx, bson.M{"_id": id})
-			if mongoResult != nil {
-				mongoResult.Decode(&result)
-				return result
-			}
-
+	coll := t.mgoClient.Database(dbName).Collection(collectionName)
+	start := time.Now()
+	err := coll.FindOne(context.Background(), bson.M{"_id": id}).Decode(&result)
+	metrics.observe("monresql_mongo_read_seconds", time.Since(start), "sync", t.syncName, "namespace", createFanKey(dbName, collectionName))
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Errorf("Unable to read %s.%s %v : %s", dbName, collectionName, id, err.Error())
+		}
+		return nil
+	}
+	return result
+}
+
+// prepareUpdate turns the update op into either a partial update, returning the
+// mapped fields it changes, or a full document upsert. It returns ok false
+// when there is nothing to write.
+func (t *syncronizer) prepareUpdate(db, collectionName string, c coll, op *gtm.Op) (fields []string, partial bool, ok bool) {
+	// the oplog entry holds the update itself, gtm passes it as is
+	if op.UpdateDescription == nil && !t.setting.changeStream && op.Data != nil {
+		desc, replace, ok := oplogUpdate(op.Data)
+		switch {
+		case replace:
+			op.Data["_id"] = op.Id
+		case ok:
+			op.UpdateDescription = desc
+			op.Data = nil
+		default:
+			op.Data = nil
+		}
+	}
+	// an update of a filtered field can make the document match or stop matching
+	// so does an update of an array of child rows, they are replaced from the whole array,
+	// and a version of the history holds the whole document. A document with dead
+	// letters is written whole so the write supersedes them.
+	if !t.setting.fullDocument && !c.History && !t.deadLetters.has(op.Namespace, op.Id) && op.UpdateDescription != nil && !filterChanged(c.Filter, op.UpdateDescription) &&
+		!pathsOverlap(updatedPaths(op.UpdateDescription), c.Children.paths()) && c.partialPaths(updatedPaths(op.UpdateDescription)) {
+		data, fields, ok := partialUpdate(c.Fields, op.UpdateDescription)
+		if ok {
+			op.Data = data
+			return fields, true, len(fields) > 0
+		}
+	}
+	// Change stream updates carry no document unless asked for one, oplog updates never do
+	if t.setting.fullDocument || op.Data["_id"] == nil {
+		op.Data = t.getMongoDocById(db, collectionName, op.Id)
+		if op.Data == nil {
+			// deleted in the meantime, its delete op follows
+			return nil, false, false
 		}
 	}
+	return nil, false, true
+}
+
+// processOp applies the op or else saves it as a dead letter, it returns an
+// error when neither could be done so the op is not completed
+func (t *syncronizer) processOp(op *gtm.Op, ctx context.Context) error {
+	attempts, err := t.setting.retry.do(ctx, func() error {
+		return t.applyOp(t.pg, op)
+	})
+	if err == nil {
+		return nil
+	}
+	t.status.setError(err)
+	metrics.inc("monresql_ops_failed_total", t.opLabels(op)...)
+	if _, saveErr := t.setting.retry.do(ctx, func() error {
+		return t.deadLetters.save(t.pg, op, err, attempts)
+	}); saveErr != nil {
+		return fmt.Errorf("unable to dead letter %s %v : %w", op.Namespace, op.Id, saveErr)
+	}
 	return nil
 }
 
-func (t *syncronizer) processOp(op *gtm.Op) {
+// applyOp writes the op through ex, which is either the
+// database itself or the transaction of a batch
+func (t *syncronizer) applyOp(ex sqlx.Ext, op *gtm.Op) error {
 	collectionName := op.GetCollection()
 	db := op.GetDatabase()
 	st := replica{Config: t.fieldMap}
 	o, c := st.statementFromDbCollection(db, collectionName)
+	var updateFields []string
+	var partial bool
 	if op.IsUpdate() {
-		op.Data = t.getMongoDocById(op.Id)
+		var ok bool
+		updateFields, partial, ok = t.prepareUpdate(db, collectionName, c, op)
+		if !ok {
+			t.counters.skipped.Incr(1)
+			metrics.inc("monresql_ops_skipped_total", t.opLabels(op)...)
+			return nil
+		}
 	}
-	data := sanitizeData(c.Fields, op)
+	// a partial update of a document outside the filter has no row to update
+	unmatched := (op.IsInsert() || op.IsUpdate() && !partial) && !c.matches(op.Data)
+	if unmatched && op.IsInsert() {
+		t.counters.skipped.Incr(1)
+		metrics.inc("monresql_ops_skipped_total", t.opLabels(op)...)
+		return nil
+	}
+	data := c.sanitize(op)
+	var query string
 	switch {
 	case op.IsInsert():
 		t.counters.insert.Incr(1)
-		upsertSQL := o.BuildUpsert()
-		_, err := t.pg.NamedExec(upsertSQL, data)
-		if err != nil {
-			log.Error(upsertSQL, "data : ", data, " tailing insert error : ", err)
-		}
-
+		query = o.BuildUpsert()
+	case op.IsUpdate() && unmatched:
+		// the document stopped matching the filter
+		t.counters.delete.Incr(1)
+		query = o.BuildDelete()
 	case op.IsUpdate():
 		t.counters.update.Incr(1)
-		updateSQL := o.BuildUpsert()
-		_, err := t.pg.NamedExec(updateSQL, data)
-		if err != nil {
-			log.Error(updateSQL, "data : ", data, " tailing update error : ", err)
+		query = o.BuildUpsert()
+		if partial {
+			query = o.BuildUpdate(updateFields)
 		}
-
 	case op.IsDelete():
+		// an ignored delete still closes the version of the history
+		if query = o.BuildRemove(); query == "" && !c.History {
+			t.counters.skipped.Incr(1)
+			metrics.inc("monresql_ops_skipped_total", t.opLabels(op)...)
+			return nil
+		}
 		t.counters.delete.Incr(1)
-		deleteSQL := o.BuildDelete()
-		_, err := t.pg.NamedExec(deleteSQL, data)
-		if err != nil {
-			log.Error(deleteSQL, "data : ", data, " tailing delete error : ", err)
+	default:
+		return nil
+	}
+	// a soft deleted row keeps its child rows
+	deleted := op.IsDelete() && c.DeleteMode == DeleteHard || unmatched
+	keepChildren := op.IsDelete() && c.DeleteMode == DeleteSoft
+	start := time.Now()
+	err := withChildrenTx(context.Background(), ex, c, func(ex sqlx.Ext) error {
+		if query != "" {
+			result, err := sqlx.NamedExec(ex, query, data)
+			if err != nil {
+				return err
+			}
+			if partial {
+				if n, err := result.RowsAffected(); err == nil && n == 0 {
+					return errMissingRow
+				}
+			} else if err := t.deadLetters.supersede(ex, op.Namespace, op.Id); err != nil {
+				return err
+			}
+		}
+		if err := writeHistory(ex, c, data, opTime(op), op.IsDelete() || unmatched, false); err != nil {
+			return err
+		}
+		if keepChildren || query == "" {
+			return nil
+		}
+		return writeChildren(ex, c, op.Id, op.Data, deleted, !partial)
+	})
+	metrics.observe("monresql_postgres_write_seconds", time.Since(start), t.opLabels(op)...)
+	if errors.Is(err, errMissingRow) {
+		// the document is outside the filter or its insert was dead lettered,
+		// written whole it is either left out or upserted
+		if op.Data = t.getMongoDocById(db, collectionName, op.Id); op.Data == nil {
+			return nil
 		}
+		op.UpdateDescription = nil
+		return t.applyOp(ex, op)
 	}
+	if err != nil {
+		log.Error(query, "data : ", data, " tailing ", opName(op), " error : ", err)
+		return err
+	}
+	metrics.inc("monresql_ops_applied_total", t.opLabels(op)...)
+	return nil
+}
+
+// opLabels are the metric labels of an op
+func (t *syncronizer) opLabels(op *gtm.Op) []string {
+	return []string{"sync", t.syncName, "namespace", op.Namespace, "op", opName(op)}
 }
 
 func (t *syncronizer) ReportCounters() {
@@ -430,24 +805,25 @@ func (t *syncronizer) ReportCounters() {
 	}
 }
 
-type monresqlMetadata struct {
-	AppName     string    `db:"app_name"`
-	LastEpoch   int64     `db:"last_epoch"`
-	ProcessedAt time.Time `db:"processed_at"`
-}
-
 func newsyncronizer(fieldMap fieldsMap, pg *sqlx.DB, client *mongo.Client, syncName string, syncOptions *syncOptions) *syncronizer {
-	checkpoint := cmap.New()
-	return &syncronizer{
-		fieldMap:     fieldMap,
-		pg:           pg,
-		mgoClient:    client,
-		stopC:        make(chan bool, 5),
-		counters:     buildCounters(syncName),
-		checkpoint:   &checkpoint,
-		syncName:     syncName,
-		setting:      syncOptions,
-		psqluserName: getPqUserName(pg)}
+	store := syncOptions.store
+	if store == nil {
+		store = NewPostgresCheckpointStore(pg, syncOptions.metadataSchema, "monresql_metadata")
+	}
+	t := &syncronizer{
+		fieldMap:    fieldMap,
+		deadLetters: newDeadLetterIndex(syncOptions.metadataSchema, syncName),
+		pg:          pg,
+		mgoClient:   client,
+		fatalC:      make(chan error, 1),
+		counters:    buildCounters(),
+		checkpoint:  newWatermark(),
+		syncName:    syncName,
+		setting:     syncOptions,
+		store:       store,
+		status:      &syncStatus{state: SyncStarting}}
+	t.fan = t.newFan()
+	return t
 }
 
 func getPqUserName(pg *sqlx.DB) string {
@@ -456,30 +832,10 @@ func getPqUserName(pg *sqlx.DB) string {
 	return username
 }
 
-func fetchMetadata(pg *sqlx.DB, syncName, username string) monresqlMetadata {
-	metadata := monresqlMetadata{}
-	q := queries{}
-	err := pg.Get(&metadata, q.GetMetadata(), syncName)
-	// No rows means this is first time with table
-	if err != nil && err != sql.ErrNoRows {
-		log.Printf("Error while reading moresql_metadata table %+v", err)
-		c := commands{}
-		query := c.CreateTableSQL()
-		query1 := strings.Replace(query, "$USERNAME", username, 1)
-		log.Println("Executed Query : ", query)
-		_, err := pg.DB.Exec(query1)
-		if err != nil {
-			log.Println("MetaTable Creating Error : ", err)
-		} else {
-			log.Println("table created Sucessfuly")
-		}
-	}
-	return metadata
-}
-
 type gtmTail struct {
 	ops  gtm.OpChan
 	errs chan error
+	stop func()
 }
 
 type counters struct {
@@ -500,7 +856,7 @@ func (c *counters) All() map[string]*ratecounter.RateCounter {
 	return cx
 }
 
-func buildCounters(syncName string) (c counters) {
+func buildCounters() (c counters) {
 	c = counters{
 		ratecounter.NewRateCounter(1 * time.Second),
 		ratecounter.NewRateCounter(1 * time.Minute),
@@ -508,17 +864,8 @@ func buildCounters(syncName string) (c counters) {
 		ratecounter.NewRateCounter(1 * time.Minute),
 		ratecounter.NewRateCounter(1 * time.Minute),
 	}
-	time := fmt.Sprint(time.Now())
-	insert := "insert/min" + syncName + time
-	update := "update/min" + syncName + time
-	delete := "delete/min" + syncName + time
-	ops := "ops/min" + syncName + time
-	skipped := "skipped/min" + syncName + time
-	expvar.Publish(insert, c.insert)
-	expvar.Publish(update, c.update)
-	expvar.Publish(delete, c.delete)
-	expvar.Publish(ops, c.read)
-	expvar.Publish(skipped, c.skipped)
+	// the labeled counters of the metrics registry are published under a stable name
+	publishExpvar()
 	return
 }
 
@@ -552,11 +899,3 @@ func opTimestampWrapper(f func() time.Time, ago time.Duration) func(*mongo.Clien
 // 	}
 // 	return false
 // }
-
-// func (t *syncronizer) msLag(epoch int32, nowFunc func() time.Time) int64 {
-// 	// TODO: use time.Duration instead of this malarky
-// 	ts := time.Unix(int64(epoch), 0)
-// 	d := nowFunc().Sub(ts)
-// 	nanoToMillisecond := func(t time.Duration) int64 { return t.Nanoseconds() / 1e6 }
-// 	return nanoToMillisecond(d)
-// }
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"testing"
+
+	"github.com/rwynn/gtm/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// testSync builds a syncronizer of the mapfile without any connection
+func testSync(t *testing.T, mapfile string) *syncronizer {
+	t.Helper()
+	fieldMap, err := jsonToFieldsMap(mapfile)
+	if err != nil {
+		t.Fatalf("jsonToFieldsMap() error: %v", err)
+	}
+	options := NewSyncOptions()
+	options.SetCheckpointStore(NewMemoryCheckpointStore())
+	return newsyncronizer(fieldMap, nil, nil, "test", options)
+}
+
+// dispatched sends the op through the reader and returns it as the consumer reads it
+func dispatched(t *testing.T, sync *syncronizer, op *gtm.Op) *gtm.Op {
+	t.Helper()
+	sync.dispatch(op)
+	select {
+	case out := <-sync.fan[op.Namespace]:
+		return out
+	default:
+		t.Fatalf("op of %s was not sent to its collection", op.Namespace)
+		return nil
+	}
+}
+
+func TestDispatchFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+		data   map[string]interface{}
+		want   bool
+	}{
+		{"missing mapped field not exists", `{"archived": {"$exists": false}}`, map[string]interface{}{"_id": "1", "name": "x"}, true},
+		{"missing mapped field exists", `{"archived": {"$exists": true}}`, map[string]interface{}{"_id": "1", "name": "x"}, false},
+		{"present mapped field not exists", `{"archived": {"$exists": false}}`, map[string]interface{}{"_id": "1", "archived": true}, false},
+		{"present mapped field exists", `{"archived": {"$exists": true}}`, map[string]interface{}{"_id": "1", "archived": nil}, true},
+		{"missing mapped field null", `{"archived": null}`, map[string]interface{}{"_id": "1"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sync := testSync(t, `{"app": {"collections": {"users": {"name": "users", "filter": `+tt.filter+`,
+				"fields": {"_id": "TEXT", "name": "TEXT", "archived": "BOOLEAN"}}}}}`)
+			op := dispatched(t, sync, &gtm.Op{Id: "1", Operation: "i", Namespace: "app.users", Data: tt.data})
+			c := sync.fieldMap["app"].Collections["users"]
+			if got := c.matches(op.Data); got != tt.want {
+				t.Fatalf("matches(%v) = %v, want %v", op.Data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDispatchUnmappedCollection(t *testing.T) {
+	sync := testSync(t, `{"app": {"collections": {"users": {"name": "users", "fields": {"_id": "TEXT"}}}}}`)
+	sync.dispatch(&gtm.Op{Id: "1", Operation: "i", Namespace: "app.other", Data: bson.M{"_id": "1"}})
+	if n := sync.checkpoint.pending(); n != 0 {
+		t.Fatalf("pending() = %d, want the op of an unmapped collection completed", n)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"context"
+	"time"
+
+	"github.com/rwynn/gtm/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// transactionalConsumer is the single writer of the transactional mode,
+// it collects the ops in micro batches and commits each one with its checkpoint
+func (t *syncronizer) transactionalConsumer(in <-chan *gtm.Op, ctx context.Context) {
+	ticker := time.NewTicker(t.setting.batchPeriod)
+	defer ticker.Stop()
+	batch := make([]*gtm.Op, 0, t.setting.batchSize)
+	for {
+		select {
+		case op := <-in:
+			batch = append(batch, op)
+			if len(batch) < t.setting.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-ctx.Done():
+			// the uncommitted batch is replayed from the last checkpoint
+			return
+		}
+		// a batch is never skipped, it is retried until it commits
+		for attempt := 1; ; attempt++ {
+			err := t.commitBatch(batch)
+			if err == nil {
+				break
+			}
+			t.status.setError(err)
+			log.Errorf("Batch of %d ops not committed, retrying : %s", len(batch), err.Error())
+			select {
+			case <-time.After(t.setting.retry.backoff(attempt)):
+			case <-ctx.Done():
+				return
+			}
+		}
+		batch = make([]*gtm.Op, 0, t.setting.batchSize)
+	}
+}
+
+// commitBatch applies the ops and saves the checkpoint of the last one in a
+// single transaction. Every op runs under a savepoint so a failing op is
+// rolled back and dead lettered without aborting the rest of the batch.
+func (t *syncronizer) commitBatch(batch []*gtm.Op) error {
+	tx, err := t.pg.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, op := range batch {
+		if _, err := tx.Exec("SAVEPOINT monresql_op"); err != nil {
+			return err
+		}
+		if opErr := t.applyOp(tx, op); opErr != nil {
+			if t.setting.retry.retryable(opErr) {
+				// transient, the whole batch is tried again
+				return opErr
+			}
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT monresql_op"); err != nil {
+				return err
+			}
+			metrics.inc("monresql_ops_failed_total", t.opLabels(op)...)
+			// the dead letter commits with the batch, so it is recorded exactly once too
+			if err := t.deadLetters.save(tx, op, opErr, 1); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := tx.Exec("RELEASE SAVEPOINT monresql_op"); err != nil {
+			return err
+		}
+	}
+	last := t.opToCheckpoint(batch[len(batch)-1])
+	store, inTx := t.store.(txCheckpointStore)
+	if t.setting.checkpoint && inTx {
+		if err := store.saveTx(tx, last); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if t.setting.checkpoint && !inTx {
+		// other stores can only save once the batch is committed
+		t.saveCheckpoint(last)
+	}
+	for _, op := range batch {
+		t.status.applied(op)
+		t.checkpoint.complete(op)
+	}
+	return nil
+}
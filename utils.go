@@ -24,10 +24,13 @@ package monresql
 
 import (
 	"encoding/json"
+	"sort"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/tidwall/gjson"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/rwynn/gtm/v2"
@@ -85,16 +88,184 @@ func sanitizeData(pgFields fields, op *gtm.Op) map[string]interface{} {
 	}
 	// log.Println("opId : ", op.Id, " : ", reflect.TypeOf(op.Id))
 	if op.Id != nil {
-		switch op.Id.(type) {
-		case primitive.ObjectID:
-			bid := op.Id.(primitive.ObjectID)
-			output["_id"] = bid.Hex()
+		output["_id"] = pgID(op.Id)
+	}
+
+	return output
+}
+
+// pgID is how a mongo _id is written in postgres
+func pgID(id interface{}) interface{} {
+	switch id.(type) {
+	case primitive.ObjectID:
+		bid := id.(primitive.ObjectID)
+		return bid.Hex()
+	default:
+		return id
+	}
+}
+
+// partialUpdate builds the document and the list of changed mapped fields from a
+// change stream update description. ok is false when a mapped field was changed
+// below its own path, e.g. one key of a JSONB object or one array element,
+// since the new column value can't be told without the whole document.
+func partialUpdate(pgFields fields, desc map[string]interface{}) (data map[string]interface{}, changed []string, ok bool) {
+	data = make(map[string]interface{})
+	if updated, found := desc["updatedFields"].(bson.M); found {
+		for p, v := range updated {
+			setPath(data, p, v)
+		}
+	}
+	if removed, found := desc["removedFields"].(bson.A); found {
+		for _, p := range removed {
+			if p, isString := p.(string); isString {
+				setPath(data, p, nil)
+			}
+		}
+	}
+	paths := updatedPaths(desc)
+	touched := make(map[string]bool)
+	for _, p := range paths {
+		for k := range pgFields {
+			if strings.HasPrefix(p, k+".") {
+				return nil, nil, false
+			}
+			if k == p || strings.HasPrefix(k, p+".") {
+				touched[k] = true
+			}
+		}
+	}
+	for k := range touched {
+		if k != "_id" {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return data, changed, true
+}
+
+// oplogUpdate reads the update document of an oplog entry as a change stream
+// update description. replace is true when the entry holds the whole new
+// document instead of update operators. ok is false when the new values can't
+// be told from the entry, like the element diffs of an array. update must be
+// the "o" field as gtm reads it, with no placeholder for the missing fields.
+func oplogUpdate(update map[string]interface{}) (desc map[string]interface{}, replace bool, ok bool) {
+	operators := false
+	for k := range update {
+		operators = operators || strings.HasPrefix(k, "$")
+	}
+	if !operators {
+		return nil, true, true
+	}
+	updated, removed := bson.M{}, bson.A{}
+	if diff, isDiff := asDoc(update["diff"]); isDiff {
+		// the $v:2 delta of mongo 5.0 and later
+		if !readOplogDiff(diff, "", updated, &removed) {
+			return nil, false, false
+		}
+	} else {
+		for k, v := range update {
+			switch k {
+			case "$set":
+				set, isDoc := asDoc(v)
+				if !isDoc {
+					return nil, false, false
+				}
+				for p, value := range set {
+					updated[p] = value
+				}
+			case "$unset":
+				unset, isDoc := asDoc(v)
+				if !isDoc {
+					return nil, false, false
+				}
+				for p := range unset {
+					removed = append(removed, p)
+				}
+			case "$v":
+			default:
+				return nil, false, false
+			}
+		}
+	}
+	return map[string]interface{}{"updatedFields": updated, "removedFields": removed}, false, true
+}
+
+// readOplogDiff flattens a $v:2 diff: u updates and i inserts fields, d
+// deletes them and s<field> holds the diff of an embedded document
+func readOplogDiff(diff map[string]interface{}, prefix string, updated bson.M, removed *bson.A) bool {
+	if _, isArray := diff["a"]; isArray {
+		return false
+	}
+	for k, v := range diff {
+		switch {
+		case k == "u" || k == "i":
+			set, isDoc := asDoc(v)
+			if !isDoc {
+				return false
+			}
+			for p, value := range set {
+				updated[prefix+p] = value
+			}
+		case k == "d":
+			unset, isDoc := asDoc(v)
+			if !isDoc {
+				return false
+			}
+			for p := range unset {
+				*removed = append(*removed, prefix+p)
+			}
+		case strings.HasPrefix(k, "s"):
+			sub, isDoc := asDoc(v)
+			if !isDoc || !readOplogDiff(sub, prefix+k[1:]+".", updated, removed) {
+				return false
+			}
 		default:
-			output["_id"] = op.Id
+			return false
 		}
 	}
+	return true
+}
 
-	return output
+// updatedPaths lists the paths an update description sets, removes or truncates
+func updatedPaths(desc map[string]interface{}) []string {
+	paths := []string{}
+	if updated, found := desc["updatedFields"].(bson.M); found {
+		for p := range updated {
+			paths = append(paths, p)
+		}
+	}
+	if removed, found := desc["removedFields"].(bson.A); found {
+		for _, p := range removed {
+			if p, isString := p.(string); isString {
+				paths = append(paths, p)
+			}
+		}
+	}
+	if truncated, found := desc["truncatedArrays"].(bson.A); found {
+		for _, t := range truncated {
+			if t, isDoc := t.(bson.M); isDoc {
+				if p, isString := t["field"].(string); isString {
+					paths = append(paths, p)
+				}
+			}
+		}
+	}
+	return paths
+}
+
+// setPath sets the value of a dotted path, creating the parent documents
+func setPath(doc map[string]interface{}, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		child, ok := doc[k].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			doc[k] = child
+		}
+		doc = child
+	}
+	doc[keys[len(keys)-1]] = value
 }
 
 func createFanKey(db string, collection string) string {
@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/rwynn/gtm/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestUpdatedPaths(t *testing.T) {
+	tests := []struct {
+		name string
+		desc map[string]interface{}
+		want []string
+	}{
+		{"empty", map[string]interface{}{}, []string{}},
+		{"updated", map[string]interface{}{"updatedFields": bson.M{"a": 1, "b.c": 2}}, []string{"a", "b.c"}},
+		{"removed", map[string]interface{}{"removedFields": bson.A{"a", "b"}}, []string{"a", "b"}},
+		{"truncated", map[string]interface{}{"truncatedArrays": bson.A{bson.M{"field": "items", "newSize": 1}}}, []string{"items"}},
+		{"all", map[string]interface{}{
+			"updatedFields":   bson.M{"a": 1},
+			"removedFields":   bson.A{"b"},
+			"truncatedArrays": bson.A{bson.M{"field": "c", "newSize": 0}},
+		}, []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := updatedPaths(tt.desc)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("updatedPaths() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPartialUpdate(t *testing.T) {
+	f := fields{
+		"_id":          field{mongoDB{"_id", "id"}, postgresDB{"_id", "text"}},
+		"name":         field{mongoDB{"name", "string"}, postgresDB{"name", "text"}},
+		"address.city": field{mongoDB{"address.city", "string"}, postgresDB{"address_city", "text"}},
+		"meta":         field{mongoDB{"meta", "object"}, postgresDB{"meta", "jsonb"}},
+	}
+	tests := []struct {
+		name    string
+		desc    map[string]interface{}
+		data    map[string]interface{}
+		changed []string
+		ok      bool
+	}{
+		{
+			name:    "set a field",
+			desc:    map[string]interface{}{"updatedFields": bson.M{"name": "x"}},
+			data:    map[string]interface{}{"name": "x"},
+			changed: []string{"name"},
+			ok:      true,
+		},
+		{
+			name:    "set a dotted field",
+			desc:    map[string]interface{}{"updatedFields": bson.M{"address.city": "y"}},
+			data:    map[string]interface{}{"address": map[string]interface{}{"city": "y"}},
+			changed: []string{"address.city"},
+			ok:      true,
+		},
+		{
+			name:    "replace the parent of a mapped field",
+			desc:    map[string]interface{}{"updatedFields": bson.M{"address": bson.M{"city": "z"}}},
+			data:    map[string]interface{}{"address": bson.M{"city": "z"}},
+			changed: []string{"address.city"},
+			ok:      true,
+		},
+		{
+			name:    "remove a field",
+			desc:    map[string]interface{}{"removedFields": bson.A{"name"}},
+			data:    map[string]interface{}{"name": nil},
+			changed: []string{"name"},
+			ok:      true,
+		},
+		{
+			name: "unmapped field",
+			desc: map[string]interface{}{"updatedFields": bson.M{"other": 1}},
+			data: map[string]interface{}{"other": 1},
+			ok:   true,
+		},
+		{
+			name: "below a mapped field",
+			desc: map[string]interface{}{"updatedFields": bson.M{"meta.key": 1}},
+			ok:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, changed, ok := partialUpdate(f, tt.desc)
+			if ok != tt.ok {
+				t.Fatalf("partialUpdate() ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if !reflect.DeepEqual(changed, tt.changed) {
+				t.Fatalf("partialUpdate() changed = %v, want %v", changed, tt.changed)
+			}
+			if !reflect.DeepEqual(data, tt.data) {
+				t.Fatalf("partialUpdate() data = %#v, want %#v", data, tt.data)
+			}
+		})
+	}
+}
+
+func TestOplogUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		update  map[string]interface{}
+		updated bson.M
+		removed bson.A
+		replace bool
+		ok      bool
+	}{
+		{
+			name:    "replacement",
+			update:  map[string]interface{}{"_id": 1, "name": "x"},
+			replace: true,
+			ok:      true,
+		},
+		{
+			name:    "set and unset",
+			update:  map[string]interface{}{"$v": 1, "$set": bson.M{"a.b": 1}, "$unset": bson.M{"c": true}},
+			updated: bson.M{"a.b": 1},
+			removed: bson.A{"c"},
+			ok:      true,
+		},
+		{
+			name: "diff",
+			update: map[string]interface{}{"$v": 2, "diff": bson.M{
+				"u":  bson.M{"a": 1},
+				"i":  bson.M{"b": 2},
+				"d":  bson.M{"c": false},
+				"sd": bson.M{"u": bson.M{"e": 3}, "se": bson.M{"d": bson.M{"f": false}}},
+			}},
+			updated: bson.M{"a": 1, "b": 2, "d.e": 3},
+			removed: bson.A{"c", "d.e.f"},
+			ok:      true,
+		},
+		{
+			name:   "array diff",
+			update: map[string]interface{}{"$v": 2, "diff": bson.M{"sitems": bson.M{"a": true, "u0": 1}}},
+			ok:     false,
+		},
+		{
+			name:   "unknown operator",
+			update: map[string]interface{}{"$inc": bson.M{"n": 1}},
+			ok:     false,
+		},
+	}
+	// the updates are read the way the sync reads them, with mapped fields
+	// missing from the update and an extras column
+	sync := testSync(t, `{"app": {"collections": {"users": {"name": "users", "extras_column": "extras",
+		"fields": {"_id": "TEXT", "name": "TEXT", "a.b": "INTEGER", "c": "TEXT"}}}}}`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op := dispatched(t, sync, &gtm.Op{Id: 1, Operation: "u", Namespace: "app.users", Data: tt.update})
+			desc, replace, ok := oplogUpdate(op.Data)
+			if replace != tt.replace || ok != tt.ok {
+				t.Fatalf("oplogUpdate() = %v, %v, want %v, %v", replace, ok, tt.replace, tt.ok)
+			}
+			if !ok || replace {
+				return
+			}
+			if !reflect.DeepEqual(desc["updatedFields"], tt.updated) {
+				t.Fatalf("updatedFields = %v, want %v", desc["updatedFields"], tt.updated)
+			}
+			removed := desc["removedFields"].(bson.A)
+			sort.Slice(removed, func(i, j int) bool { return removed[i].(string) < removed[j].(string) })
+			if !reflect.DeepEqual(removed, tt.removed) {
+				t.Fatalf("removedFields = %v, want %v", removed, tt.removed)
+			}
+		})
+	}
+}
@@ -0,0 +1,415 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Severity tells whether a validation issue breaks the replication or only risks it
+type Severity string
+
+const (
+	// SeverityError issues make the writes fail
+	SeverityError Severity = "error"
+	// SeverityWarning issues only fail some documents or lose precision
+	SeverityWarning Severity = "warning"
+)
+
+// The kinds of validation issue
+const (
+	IssueMissingTable       = "missing_table"
+	IssueMissingColumn      = "missing_column"
+	IssueTypeMismatch       = "type_mismatch"
+	IssueNotNull            = "not_null"
+	IssueMissingUniqueIndex = "missing_unique_index"
+)
+
+// ValidationIssue is a difference between the mapping of a collection and its
+// postgres table, Suggestion is the statement fixing it
+type ValidationIssue struct {
+	Schema     string
+	Table      string
+	Column     string
+	Kind       string
+	Severity   Severity
+	Expected   string
+	Actual     string
+	Message    string
+	Suggestion string
+}
+
+type columnType struct {
+	Name     string `db:"column_name"`
+	DataType string `db:"data_type"`
+	NotNull  bool   `db:"not_null"`
+}
+
+// typeAliases maps the type names accepted in the mapfile to the name
+// postgres formats them with
+var typeAliases = map[string]string{
+	"int":         "integer",
+	"int4":        "integer",
+	"serial":      "integer",
+	"int8":        "bigint",
+	"bigserial":   "bigint",
+	"int2":        "smallint",
+	"float":       "double precision",
+	"float8":      "double precision",
+	"float4":      "real",
+	"bool":        "boolean",
+	"decimal":     "numeric",
+	"varchar":     "character varying",
+	"char":        "character",
+	"timestamp":   "timestamp without time zone",
+	"timestamptz": "timestamp with time zone",
+	"time":        "time without time zone",
+	"timetz":      "time with time zone",
+}
+
+var typeModifier = regexp.MustCompile(`^([a-z0-9 ]+?)\s*(\(.*\))?$`)
+
+// arrayBounds matches the trailing dimensions of an array type, like [] or [3][]
+var arrayBounds = regexp.MustCompile(`(\s*\[\s*\d*\s*\])+$`)
+
+// normalizeType renders a mapped type the way format_type does, the element
+// type of an array is normalized and every dimension is rendered as []
+func normalizeType(t string) string {
+	t = strings.Join(strings.Fields(strings.ToLower(t)), " ")
+	if bounds := arrayBounds.FindString(t); bounds != "" {
+		element := normalizeType(strings.TrimSuffix(t, bounds))
+		return element + strings.Repeat("[]", strings.Count(bounds, "["))
+	}
+	m := typeModifier.FindStringSubmatch(t)
+	if m == nil {
+		return t
+	}
+	name, modifier := m[1], strings.ReplaceAll(m[2], " ", "")
+	if alias, ok := typeAliases[name]; ok {
+		name = alias
+	}
+	if modifier == "" {
+		return name
+	}
+	// the modifier of timestamps goes between the name and the time zone
+	if rest, ok := strings.CutPrefix(name, "timestamp "); ok {
+		return "timestamp" + modifier + " " + rest
+	}
+	return name + modifier
+}
+
+// safeWidenings are the column changes keeping every value of the narrower type
+var safeWidenings = map[string][]string{
+	"smallint":          {"integer", "bigint", "numeric"},
+	"integer":           {"bigint", "numeric"},
+	"bigint":            {"numeric"},
+	"real":              {"double precision"},
+	"character varying": {"text"},
+	"character":         {"character varying", "text"},
+	"json":              {"jsonb"},
+}
+
+// widens reports whether a column of type wide holds every value of type narrow
+func widens(narrow, wide string) bool {
+	// an array widens when its element type does, with the same dimensions
+	narrowElem, narrowArr := strings.CutSuffix(narrow, "[]")
+	wideElem, wideArr := strings.CutSuffix(wide, "[]")
+	if narrowArr || wideArr {
+		return narrowArr && wideArr && widens(narrowElem, wideElem)
+	}
+	base := func(t string) string {
+		if i := strings.Index(t, "("); i >= 0 {
+			return t[:i]
+		}
+		return t
+	}
+	if base(narrow) == base(wide) && base(wide) == "character varying" {
+		if !strings.Contains(wide, "(") {
+			return true
+		}
+		return strings.Contains(narrow, "(") && varcharLength(wide) >= varcharLength(narrow)
+	}
+	for _, t := range safeWidenings[base(narrow)] {
+		if t == wide || (t == "character varying" && base(wide) == t) {
+			return true
+		}
+	}
+	return false
+}
+
+func varcharLength(t string) int {
+	var n int
+	if i := strings.Index(t, "("); i >= 0 {
+		fmt.Sscanf(t[i:], "(%d)", &n)
+	}
+	return n
+}
+
+// tableIssues compares the columns of a table with the fields mapped to it,
+// the required columns are always written so they may be NOT NULL
+func tableIssues(pg *sqlx.DB, schema, table string, f fields, required ...string) ([]ValidationIssue, error) {
+	q := queries{}
+	columns := []columnType{}
+	if err := pg.Select(&columns, q.GetColumnTypes(), schema, table); err != nil {
+		return nil, err
+	}
+	quoted := quoteTable(schema, table)
+	issues := []ValidationIssue{}
+	if len(columns) == 0 {
+		create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s();", quoted)
+		if schema != defaultSchema {
+			create = fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS "%s";`, schema) + "\n" + create
+		}
+		issues = append(issues, ValidationIssue{Schema: schema, Table: table, Kind: IssueMissingTable, Severity: SeverityError,
+			Message: "Missing Table", Suggestion: create})
+	}
+	isRequired := make(map[string]bool)
+	for _, r := range required {
+		isRequired[r] = true
+	}
+	existing := make(map[string]columnType)
+	for _, c := range columns {
+		existing[c.Name] = c
+	}
+	keys := []string{}
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		field := f[k]
+		name := field.Postgres.Name
+		expected := normalizeType(field.Postgres.Type)
+		column, ok := existing[name]
+		if !ok {
+			t := tableColumn{Schema: schema, Table: table, Column: name, Type: field.Postgres.Type}
+			message := "Missing Column"
+			if name != strings.ToLower(name) {
+				message += ", postgres folds the unquoted column names to lower case, map it to a lower case name"
+			}
+			issues = append(issues, ValidationIssue{Schema: schema, Table: table, Column: name, Kind: IssueMissingColumn,
+				Severity: SeverityError, Expected: expected, Message: message, Suggestion: t.createColumn()})
+			continue
+		}
+		if expected != "" && column.DataType != expected {
+			issue := ValidationIssue{Schema: schema, Table: table, Column: name, Kind: IssueTypeMismatch,
+				Severity: SeverityError, Expected: expected, Actual: column.DataType,
+				Message:    fmt.Sprintf("Column type is %s, the mapping expects %s", column.DataType, expected),
+				Suggestion: fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN "%s" TYPE %s USING "%s"::%s;`, quoted, name, expected, name, expected)}
+			if widens(expected, column.DataType) {
+				// the column already holds every mapped value, narrowing it would lose data
+				issue.Severity = SeverityWarning
+				issue.Suggestion = ""
+			}
+			issues = append(issues, issue)
+		}
+		if column.NotNull && !isRequired[name] {
+			issues = append(issues, ValidationIssue{Schema: schema, Table: table, Column: name, Kind: IssueNotNull,
+				Severity: SeverityWarning, Expected: "NULL", Actual: "NOT NULL",
+				Message:    "Column is NOT NULL, documents without the field fail to write",
+				Suggestion: fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN "%s" DROP NOT NULL;`, quoted, name)})
+		}
+	}
+	return issues, nil
+}
+
+// ValidationReport lists the differences between the mapping and the postgres
+// tables by kind. Building it only reads the database, SQL renders the
+// statements fixing the drift and Apply runs them.
+type ValidationReport struct {
+	Tables         []string
+	MissingTables  []ValidationIssue
+	MissingColumns []ValidationIssue
+	TypeMismatches []ValidationIssue
+	NotNulls       []ValidationIssue
+	MissingIndexes []ValidationIssue
+}
+
+func (r *ValidationReport) add(issues ...ValidationIssue) {
+	for _, i := range issues {
+		switch i.Kind {
+		case IssueMissingTable:
+			r.MissingTables = append(r.MissingTables, i)
+		case IssueMissingColumn:
+			r.MissingColumns = append(r.MissingColumns, i)
+		case IssueTypeMismatch:
+			r.TypeMismatches = append(r.TypeMismatches, i)
+		case IssueNotNull:
+			r.NotNulls = append(r.NotNulls, i)
+		case IssueMissingUniqueIndex:
+			r.MissingIndexes = append(r.MissingIndexes, i)
+		}
+	}
+}
+
+// Issues lists every issue in the order their fixes have to run
+func (r *ValidationReport) Issues() []ValidationIssue {
+	issues := []ValidationIssue{}
+	for _, kind := range [][]ValidationIssue{r.MissingTables, r.MissingColumns, r.TypeMismatches, r.NotNulls, r.MissingIndexes} {
+		issues = append(issues, kind...)
+	}
+	return issues
+}
+
+// OK is true when no issue makes the writes fail, warnings are allowed
+func (r *ValidationReport) OK() bool {
+	for _, i := range r.Issues() {
+		if i.Severity == SeverityError {
+			return false
+		}
+	}
+	return true
+}
+
+// HasDrift is true when the tables differ from the mapping in any way
+func (r *ValidationReport) HasDrift() bool {
+	return len(r.Issues()) > 0
+}
+
+// SQL renders the statements fixing the drift, one per line
+func (r *ValidationReport) SQL() string {
+	return r.sql(r.Issues())
+}
+
+func (r *ValidationReport) sql(issues []ValidationIssue) string {
+	statements := []string{}
+	for _, i := range issues {
+		if i.Suggestion != "" {
+			statements = append(statements, i.Suggestion)
+		}
+	}
+	if len(statements) == 0 {
+		return ""
+	}
+	return strings.Join(statements, "\n") + "\n"
+}
+
+// Apply runs the SQL of the report in one transaction
+func (r *ValidationReport) Apply(pg *sqlx.DB) error {
+	return applySQL(pg, r.SQL())
+}
+
+// applyCreates only creates the missing tables, columns and indexes
+func (r *ValidationReport) applyCreates(pg *sqlx.DB) error {
+	creates := append(append(append([]ValidationIssue{}, r.MissingTables...), r.MissingColumns...), r.MissingIndexes...)
+	return applySQL(pg, r.sql(creates))
+}
+
+func applySQL(pg *sqlx.DB, query string) error {
+	if query == "" {
+		return nil
+	}
+	tx, err := pg.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(query); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Error summarizes the issues failing the writes
+func (r *ValidationReport) Error() string {
+	lines := []string{}
+	for _, i := range r.Issues() {
+		if i.Severity == SeverityError {
+			lines = append(lines, fmt.Sprintf("%s %s: %s", quoteTable(i.Schema, i.Table), i.Column, i.Message))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// CheckSchemaDrift compares the postgres tables with the mapping: missing
+// tables and columns, column types, nullability and the unique index on _id
+// the upserts need. It only reads the database.
+func CheckSchemaDrift(fieldMap fieldsMap, pg *sqlx.DB) (*ValidationReport, error) {
+	q := queries{}
+	report := &ValidationReport{}
+	for _, db := range fieldMap {
+		for _, coll := range db.Collections {
+			report.Tables = append(report.Tables, quoteTable(coll.PgSchema, coll.PgTable))
+			id := coll.Fields["_id"].Postgres.Name
+			found, err := tableIssues(pg, coll.PgSchema, coll.PgTable, coll.tableFields(), id)
+			if err != nil {
+				return report, err
+			}
+			report.add(found...)
+			r := hasUniqueIndex{}
+			if len(found) == 0 || found[0].Kind != IssueMissingTable {
+				if err := pg.Get(&r, q.GetTableColumnIndexMetadata(), coll.PgTable, id, coll.PgSchema); err != nil {
+					return report, err
+				}
+			}
+			if !r.isValid() {
+				t := tableColumn{Schema: coll.PgSchema, Table: coll.PgTable, Column: id}
+				report.add(ValidationIssue{Schema: coll.PgSchema, Table: coll.PgTable, Column: id,
+					Kind: IssueMissingUniqueIndex, Severity: SeverityError, Expected: "UNIQUE",
+					Message: "Missing Unique Index on Column", Suggestion: t.uniqueIndex()})
+			}
+			if coll.History {
+				report.Tables = append(report.Tables, coll.historyTableQuoted())
+				found, err := tableIssues(pg, coll.PgSchema, coll.historyTable(), coll.historyFields(), validFromColumn)
+				if err != nil {
+					return report, err
+				}
+				report.add(found...)
+			}
+			for _, path := range coll.Children.paths() {
+				ch := coll.Children[path]
+				report.Tables = append(report.Tables, quoteTable(ch.PgSchema, ch.PgTable))
+				found, err := tableIssues(pg, ch.PgSchema, ch.PgTable, childFields(coll, ch), ch.ParentKey, ch.IndexColumn)
+				if err != nil {
+					return report, err
+				}
+				report.add(found...)
+				// every write deletes the child rows of its parent through this index
+				indexed := false
+				if len(found) == 0 || found[0].Kind != IssueMissingTable {
+					if err := pg.Get(&indexed, q.HasChildIndex(), ch.PgSchema, ch.PgTable, ch.ParentKey, ch.IndexColumn); err != nil {
+						return report, err
+					}
+				}
+				if !indexed {
+					report.add(ValidationIssue{Schema: ch.PgSchema, Table: ch.PgTable, Column: ch.ParentKey,
+						Kind: IssueMissingUniqueIndex, Severity: SeverityWarning, Expected: "UNIQUE (" + ch.ParentKey + ", " + ch.IndexColumn + ")",
+						Message: "Missing Unique Index on the parent key and index columns", Suggestion: ch.uniqueIndex()})
+				}
+			}
+		}
+	}
+	sort.Strings(report.Tables)
+	for _, kind := range []*[]ValidationIssue{&report.MissingTables, &report.MissingColumns, &report.TypeMismatches, &report.NotNulls, &report.MissingIndexes} {
+		issues := *kind
+		sort.SliceStable(issues, func(i, j int) bool {
+			return quoteTable(issues[i].Schema, issues[i].Table) < quoteTable(issues[j].Schema, issues[j].Table)
+		})
+	}
+	return report, nil
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import "testing"
+
+func TestNormalizeType(t *testing.T) {
+	tests := []struct {
+		mapped string
+		want   string
+	}{
+		{"int", "integer"},
+		{"INT4", "integer"},
+		{"bigserial", "bigint"},
+		{"TEXT", "text"},
+		{"varchar(20)", "character varying(20)"},
+		{"VARCHAR (20)", "character varying(20)"},
+		{"numeric(10, 2)", "numeric(10,2)"},
+		{"timestamptz", "timestamp with time zone"},
+		{"timestamp(3)", "timestamp(3) without time zone"},
+		{"timestamp(3) with time zone", "timestamp(3) with time zone"},
+		{"double  precision", "double precision"},
+		{"int[]", "integer[]"},
+		{"INT4 []", "integer[]"},
+		{"varchar[]", "character varying[]"},
+		{"varchar(20)[]", "character varying(20)[]"},
+		{"timestamptz[]", "timestamp with time zone[]"},
+		{"text[3]", "text[]"},
+		{"int[][]", "integer[][]"},
+		{"jsonb[]", "jsonb[]"},
+	}
+	for _, tt := range tests {
+		if got := normalizeType(tt.mapped); got != tt.want {
+			t.Errorf("normalizeType(%q) = %q, want %q", tt.mapped, got, tt.want)
+		}
+	}
+}
+
+func TestWidens(t *testing.T) {
+	tests := []struct {
+		narrow string
+		wide   string
+		want   bool
+	}{
+		{"integer", "bigint", true},
+		{"smallint", "integer", true},
+		{"bigint", "integer", false},
+		{"integer", "numeric", true},
+		{"real", "double precision", true},
+		{"double precision", "real", false},
+		{"character varying(20)", "text", true},
+		{"character varying(20)", "character varying", true},
+		{"character varying(20)", "character varying(40)", true},
+		{"character varying(40)", "character varying(20)", false},
+		{"character varying", "character varying(20)", false},
+		{"character(2)", "character varying", true},
+		{"text", "character varying", false},
+		{"json", "jsonb", true},
+		{"jsonb", "json", false},
+		{"integer", "integer", false},
+		{"integer[]", "bigint[]", true},
+		{"character varying[]", "text[]", true},
+		{"bigint[]", "integer[]", false},
+		{"integer", "bigint[]", false},
+		{"integer[]", "bigint", false},
+		{"integer[]", "bigint[][]", false},
+	}
+	for _, tt := range tests {
+		if got := widens(tt.narrow, tt.wide); got != tt.want {
+			t.Errorf("widens(%q, %q) = %v, want %v", tt.narrow, tt.wide, got, tt.want)
+		}
+	}
+}
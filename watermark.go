@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import "sync"
+
+// watermark tracks every op from the moment it is read until a worker has
+// finished it. The ops are numbered in read order and the watermark only
+// moves over an op once it and all the ops read before it are finished,
+// so a fast worker can't push the checkpoint past an op a slow one holds.
+type watermark struct {
+	mu       sync.Mutex
+	next     uint64
+	low      uint64
+	seqs     map[interface{}]uint64
+	values   map[uint64]interface{}
+	finished map[uint64]bool
+	last     interface{}
+}
+
+func newWatermark() *watermark {
+	return &watermark{
+		seqs:     make(map[interface{}]uint64),
+		values:   make(map[uint64]interface{}),
+		finished: make(map[uint64]bool),
+	}
+}
+
+// track registers key as in flight, value is what
+// get returns once the watermark has passed the key
+func (w *watermark) track(key, value interface{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.seqs[key] = w.next
+	w.values[w.next] = value
+	w.next++
+}
+
+// complete marks key as finished and advances the watermark
+// over every finished op that has nothing in flight before it
+func (w *watermark) complete(key interface{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	seq, ok := w.seqs[key]
+	if !ok {
+		return
+	}
+	delete(w.seqs, key)
+	w.finished[seq] = true
+	for w.finished[w.low] {
+		w.last = w.values[w.low]
+		delete(w.finished, w.low)
+		delete(w.values, w.low)
+		w.low++
+	}
+}
+
+// get returns the value of the latest op below the watermark
+func (w *watermark) get() (interface{}, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last, w.last != nil
+}
+
+// pending is the number of ops still in flight
+func (w *watermark) pending() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.seqs)
+}
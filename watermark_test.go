@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) [2024] [ganesh v]
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package monresql
+
+import "testing"
+
+func TestWatermarkEmpty(t *testing.T) {
+	w := newWatermark()
+	if v, ok := w.get(); ok || v != nil {
+		t.Fatalf("get() = %v, %v, want nothing", v, ok)
+	}
+	if n := w.pending(); n != 0 {
+		t.Fatalf("pending() = %d, want 0", n)
+	}
+}
+
+func TestWatermarkInOrder(t *testing.T) {
+	w := newWatermark()
+	w.track("a", 1)
+	w.track("b", 2)
+	w.complete("a")
+	if v, ok := w.get(); !ok || v != 1 {
+		t.Fatalf("get() = %v, %v, want 1", v, ok)
+	}
+	w.complete("b")
+	if v, ok := w.get(); !ok || v != 2 {
+		t.Fatalf("get() = %v, %v, want 2", v, ok)
+	}
+	if n := w.pending(); n != 0 {
+		t.Fatalf("pending() = %d, want 0", n)
+	}
+}
+
+func TestWatermarkOutOfOrder(t *testing.T) {
+	w := newWatermark()
+	w.track("a", 1)
+	w.track("b", 2)
+	w.track("c", 3)
+	w.complete("c")
+	w.complete("b")
+	if v, ok := w.get(); ok {
+		t.Fatalf("get() = %v, want nothing while a is in flight", v)
+	}
+	if n := w.pending(); n != 1 {
+		t.Fatalf("pending() = %d, want 1", n)
+	}
+	w.complete("a")
+	if v, ok := w.get(); !ok || v != 3 {
+		t.Fatalf("get() = %v, %v, want 3", v, ok)
+	}
+}
+
+func TestWatermarkHoldsBehindSlowOp(t *testing.T) {
+	w := newWatermark()
+	w.track("a", 1)
+	w.track("b", 2)
+	w.track("c", 3)
+	w.complete("a")
+	w.complete("c")
+	if v, _ := w.get(); v != 1 {
+		t.Fatalf("get() = %v, want 1 while b is in flight", v)
+	}
+	w.track("d", 4)
+	w.complete("b")
+	if v, _ := w.get(); v != 3 {
+		t.Fatalf("get() = %v, want 3 while d is in flight", v)
+	}
+}
+
+func TestWatermarkUnknownKey(t *testing.T) {
+	w := newWatermark()
+	w.track("a", 1)
+	w.complete("x")
+	w.complete("a")
+	w.complete("a")
+	if v, _ := w.get(); v != 1 {
+		t.Fatalf("get() = %v, want 1", v)
+	}
+	if n := w.pending(); n != 0 {
+		t.Fatalf("pending() = %d, want 0", n)
+	}
+}